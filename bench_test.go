@@ -0,0 +1,154 @@
+package toytlv
+
+import (
+	"bytes"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// See also cmd/tlvbench to compare the results against a baseline.
+
+var benchBody = bytes.Repeat([]byte{'b'}, 200)
+
+func BenchmarkRecord(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Record('A', benchBody)
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	buf := make([]byte, 0, 1<<16)
+	b.SetBytes(int64(len(benchBody)))
+	for i := 0; i < b.N; i++ {
+		if len(buf) > 1<<15 {
+			buf = buf[:0]
+		}
+		buf = Append(buf, 'A', benchBody)
+	}
+}
+
+func BenchmarkAppendTiny(b *testing.B) {
+	buf := make([]byte, 0, 1<<16)
+	for i := 0; i < b.N; i++ {
+		if len(buf) > 1<<15 {
+			buf = buf[:0]
+		}
+		buf = AppendTiny(buf, 'a', benchBody[:8])
+	}
+}
+
+func benchStream(n, size int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		data = Append(data, 'A', benchBody[:size%len(benchBody)])
+	}
+	return data
+}
+
+func BenchmarkSplit(b *testing.B) {
+	data := benchStream(1000, 100)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _, _ = Split(data)
+	}
+}
+
+func BenchmarkTakeAnyWary(b *testing.B) {
+	data := benchStream(1000, 100)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		rest := data
+		for len(rest) > 0 {
+			_, _, rest, _ = TakeAnyWary(rest)
+		}
+	}
+}
+
+func BenchmarkFeedRecords(b *testing.B) {
+	for _, size := range []int{16, 256, 4096, 65536} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			body := bytes.Repeat([]byte{'f'}, size)
+			var data []byte
+			for len(data) < 1<<20 {
+				data = Append(data, 'F', body)
+			}
+			rdr := bytes.NewReader(data)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rdr.Reset(data)
+				feeder := Reader2Feeder{Reader: rdr}
+				for {
+					_, err := feeder.Feed()
+					if err != nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// loopback makes a TCPDepot connected to itself over 127.0.0.1,
+// the client side being client, the server side echoing or not
+func loopback(b *testing.B, client *testPeer, echo bool) (depot *TCPDepot, server *testPeer) {
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip("no loopback", err)
+	}
+	addr := lstn.Addr().String()
+	_ = lstn.Close()
+	server = newTestPeer(echo)
+	depot = &TCPDepot{}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		if conn.RemoteAddr().String() == addr {
+			return client
+		}
+		return server
+	})
+	if err = depot.Listen(addr); err != nil {
+		b.Skip("can not listen", err)
+	}
+	if err = depot.Connect(addr); err != nil {
+		b.Fatal(err)
+	}
+	return
+}
+
+func BenchmarkTCPThroughput(b *testing.B) {
+	client := newTestPeer(false)
+	depot, server := loopback(b, client, false)
+	defer depot.Close()
+	const batch = 64
+	rec := Record('T', benchBody)
+	recs := make(toyqueue.Records, batch)
+	for i := range recs {
+		recs[i] = rec
+	}
+	b.SetBytes(int64(len(rec)))
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += batch {
+		n := b.N - sent
+		if n > batch {
+			n = batch
+		}
+		client.Send(recs[:n])
+	}
+	server.Received(b.N)
+}
+
+func BenchmarkTCPLatency(b *testing.B) {
+	client := newTestPeer(false)
+	depot, _ := loopback(b, client, true)
+	defer depot.Close()
+	ping := toyqueue.Records{Record('P', []byte("ping"))}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.Send(ping)
+		client.Received(i + 1)
+	}
+}
@@ -0,0 +1,155 @@
+package toytlv
+
+import (
+	"encoding/binary"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A capture is a TLV stream of the record batches a connection
+// received ('I') and sent ('O'). A capture record body is the
+// little-endian uint64 Unix time in nanoseconds, then the records.
+const (
+	CaptureIn  = 'I'
+	CaptureOut = 'O'
+)
+
+// CaptureRecord composes a capture record of a batch.
+func CaptureRecord(dir byte, at time.Time, recs toyqueue.Records) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(at.UnixNano()))
+	body := make(toyqueue.Records, 0, len(recs)+1)
+	body = append(body, ts[:])
+	body = append(body, recs...)
+	return Record(dir, body...)
+}
+
+// TakeCapture parses a capture record.
+func TakeCapture(rec []byte) (dir byte, at time.Time, recs toyqueue.Records, err error) {
+	dir, body, rest, err := TakeAnyWary(rec)
+	if err != nil {
+		return
+	}
+	if (dir != CaptureIn && dir != CaptureOut) || len(body) < 8 || len(rest) != 0 {
+		return 0, at, nil, ErrBadRecord
+	}
+	at = time.Unix(0, int64(binary.LittleEndian.Uint64(body)))
+	recs, rest, err = Split(body[8:])
+	if err == nil && len(rest) != 0 {
+		err = ErrBadRecord
+	}
+	return
+}
+
+type captureInOut struct {
+	inout   toyqueue.FeedDrainCloser
+	capture toyqueue.Drainer
+	mx      sync.Mutex
+}
+
+// CaptureJack wraps a Jack to tee every batch a TCPConn receives or
+// sends into a capture, see Replayer. The capture function supplies
+// a Drainer (e.g. a Writer2Drainer of a file) for every connection.
+func CaptureJack(jack Jack, capture func(conn net.Conn) toyqueue.Drainer) Jack {
+	return func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return &captureInOut{
+			inout:   jack(conn),
+			capture: capture(conn),
+		}
+	}
+}
+
+func (c *captureInOut) tee(dir byte, recs toyqueue.Records) error {
+	rec := CaptureRecord(dir, time.Now(), recs)
+	c.mx.Lock()
+	err := c.capture.Drain(toyqueue.Records{rec})
+	c.mx.Unlock()
+	return err
+}
+
+func (c *captureInOut) Drain(recs toyqueue.Records) error {
+	if err := c.tee(CaptureIn, recs); err != nil {
+		return err
+	}
+	return c.inout.Drain(recs)
+}
+
+func (c *captureInOut) Feed() (recs toyqueue.Records, err error) {
+	recs, err = c.inout.Feed()
+	if len(recs) > 0 {
+		if terr := c.tee(CaptureOut, recs); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	return
+}
+
+func (c *captureInOut) Close() error {
+	err := c.inout.Close()
+	if closer, ok := c.capture.(io.Closer); ok {
+		cerr := closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Replayer feeds a capture back into a protocol handler, so the
+// handler can be regression-tested offline.
+type Replayer struct {
+	Capture toyqueue.Feeder
+	// Speed scales the original timing: 1 is real time, 10 is ten
+	// times faster; 0 is no delays at all.
+	Speed float64
+	// Outbound gets the captured outgoing records, to be compared
+	// to whatever the handler produces.
+	Outbound toyqueue.Records
+}
+
+// Replay drains the captured incoming batches into the handler.
+func (r *Replayer) Replay(into toyqueue.Drainer) error {
+	var start, first time.Time
+	for {
+		caps, err := r.Capture.Feed()
+		for _, rec := range caps {
+			dir, at, recs, perr := TakeCapture(rec)
+			if perr != nil {
+				return perr
+			}
+			if dir == CaptureOut {
+				r.Outbound = append(r.Outbound, recs...)
+				continue
+			}
+			if first.IsZero() {
+				first, start = at, time.Now()
+			} else if r.Speed > 0 {
+				due := start.Add(time.Duration(float64(at.Sub(first)) / r.Speed))
+				time.Sleep(time.Until(due))
+			}
+			if derr := into.Drain(recs); derr != nil {
+				return derr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if len(caps) == 0 {
+			return ErrBadRecord
+		}
+	}
+}
+
+// ReplayJack makes a handler with the Jack (given one end of a
+// net.Pipe for a connection) and replays the capture into it.
+// The handler is returned to collect its output.
+func (r *Replayer) ReplayJack(jack Jack) (toyqueue.FeedDrainCloser, error) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	inout := jack(conn)
+	return inout, r.Replay(inout)
+}
@@ -0,0 +1,58 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// echoer sends back whatever it receives
+type echoer struct {
+	testQueue
+}
+
+func (e *echoer) Close() error {
+	return nil
+}
+
+func TestCaptureReplay(t *testing.T) {
+	_ = os.Remove("tlvc")
+	file, err := os.Create("tlvc")
+	assert.Nil(t, err)
+	jack := CaptureJack(
+		func(conn net.Conn) toyqueue.FeedDrainCloser { return &echoer{} },
+		func(conn net.Conn) toyqueue.Drainer { return &WritCloser2DrainCloser{Writer: file} },
+	)
+	c1, c2 := net.Pipe()
+	inout := jack(c1)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, inout.Drain(Join(Record('P', []byte{byte(i)}))))
+		out, err := inout.Feed()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(out))
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Nil(t, inout.Close())
+	_ = c1.Close()
+	_ = c2.Close()
+
+	file2, err := os.Open("tlvc")
+	assert.Nil(t, err)
+	replay := Replayer{
+		Capture: &Reader2Feeder{Reader: file2},
+		Speed:   2,
+	}
+	start := time.Now()
+	handler, err := replay.ReplayJack(func(conn net.Conn) toyqueue.FeedDrainCloser { return &echoer{} })
+	assert.Nil(t, err)
+	assert.Greater(t, time.Since(start), time.Millisecond*10)
+	out, err := handler.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, replay.Outbound, out)
+	assert.Equal(t, 3, len(out))
+	_ = file2.Close()
+	_ = os.Remove("tlvc")
+}
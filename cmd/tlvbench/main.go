@@ -0,0 +1,141 @@
+// tlvbench runs the benchmarks and compares the results against
+// a saved baseline, to catch performance regressions.
+//
+//	tlvbench -save                  saves the baseline to bench.json
+//	tlvbench [-threshold 0.1]       compares, exits 1 on regressions
+//
+// Of several runs (-count), the best one counts.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Result is a benchmark's per-op numbers
+type Result struct {
+	NsOp     float64 `json:"ns_op"`
+	BytesOp  float64 `json:"b_op,omitempty"`
+	AllocsOp float64 `json:"allocs_op,omitempty"`
+}
+
+type Results map[string]Result
+
+// stray output (e.g. from stderr) may get into the line, hence .*?
+var benchLine = regexp.MustCompile(`^(Benchmark\S+?)(?:-\d+)?\s.*?\s(\d+)\s+([\d.]+) ns/op`)
+var benchUnit = regexp.MustCompile(`([\d.]+) (B|allocs)/op`)
+
+// parse reads `go test -bench` output
+func parse(out io.Reader) (Results, error) {
+	res := Results{}
+	lines := bufio.NewScanner(out)
+	for lines.Scan() {
+		line := lines.Text()
+		m := benchLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		r := Result{}
+		r.NsOp, _ = strconv.ParseFloat(m[3], 64)
+		for _, u := range benchUnit.FindAllStringSubmatch(line, -1) {
+			v, _ := strconv.ParseFloat(u[1], 64)
+			if u[2] == "B" {
+				r.BytesOp = v
+			} else {
+				r.AllocsOp = v
+			}
+		}
+		if prev, ok := res[m[1]]; !ok || prev.NsOp > r.NsOp {
+			res[m[1]] = r
+		}
+	}
+	return res, lines.Err()
+}
+
+// compare prints the difference, returns the number of regressions:
+// slower by more than the threshold, or more allocations
+func compare(out io.Writer, base, cur Results, threshold float64) (regressions int) {
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		now := cur[name]
+		was, ok := base[name]
+		if !ok {
+			_, _ = fmt.Fprintf(out, "%-40s %12s %12.1f\n", name, "new", now.NsOp)
+			continue
+		}
+		delta := (now.NsOp - was.NsOp) / was.NsOp
+		verdict := ""
+		if delta > threshold {
+			verdict = "SLOWER"
+		} else if now.AllocsOp > was.AllocsOp {
+			verdict = "ALLOCS"
+		}
+		if verdict != "" {
+			regressions++
+		}
+		_, _ = fmt.Fprintf(out, "%-40s %12.1f %12.1f %+7.1f%% %s\n", name, was.NsOp, now.NsOp, delta*100, verdict)
+	}
+	return
+}
+
+func run() (int, error) {
+	pkg := flag.String("pkg", ".", "package to benchmark")
+	bench := flag.String("bench", ".", "benchmarks to run (regexp)")
+	count := flag.Int("count", 3, "runs per benchmark")
+	baseline := flag.String("baseline", "bench.json", "baseline file")
+	save := flag.Bool("save", false, "save the results as the baseline")
+	threshold := flag.Float64("threshold", 0.1, "tolerated slowdown, 0.1 is 10%")
+	flag.Parse()
+
+	cmd := exec.Command("go", "test", "-run", "^$", "-bench", *bench,
+		"-benchmem", "-count", strconv.Itoa(*count), *pkg)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		_, _ = os.Stderr.Write(output)
+		return 1, err
+	}
+	cur, err := parse(bytes.NewReader(output))
+	if err != nil {
+		return 1, err
+	}
+	if *save {
+		js, err := json.MarshalIndent(cur, "", "  ")
+		if err != nil {
+			return 1, err
+		}
+		return 0, os.WriteFile(*baseline, js, 0644)
+	}
+	js, err := os.ReadFile(*baseline)
+	if err != nil {
+		return 1, err
+	}
+	base := Results{}
+	if err = json.Unmarshal(js, &base); err != nil {
+		return 1, err
+	}
+	if compare(os.Stdout, base, cur, *threshold) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func main() {
+	code, err := run()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(code)
+}
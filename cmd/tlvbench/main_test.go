@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const output = `goos: linux
+BenchmarkRecord-8            	 6000000	       180.1 ns/op	     208 B/op	       1 allocs/op
+BenchmarkRecord-8            	 6000000	       170.5 ns/op	     208 B/op	       1 allocs/op
+BenchmarkFeedRecords/16-8    	    2000	   2349078 ns/op	 446.38 MB/s	 5087140 B/op	    2569 allocs/op
+BenchmarkTCPLatency 	read tcp: use of closed network connection    2000	     15811 ns/op
+PASS
+`
+
+func TestParseCompare(t *testing.T) {
+	res, err := parse(strings.NewReader(output))
+	assert.Nil(t, err)
+	assert.Equal(t, Results{
+		"BenchmarkRecord":         {NsOp: 170.5, BytesOp: 208, AllocsOp: 1},
+		"BenchmarkFeedRecords/16": {NsOp: 2349078, BytesOp: 5087140, AllocsOp: 2569},
+		"BenchmarkTCPLatency":     {NsOp: 15811},
+	}, res)
+
+	cur := Results{
+		"BenchmarkRecord":         {NsOp: 200, BytesOp: 208, AllocsOp: 1},
+		"BenchmarkFeedRecords/16": {NsOp: 2349078, AllocsOp: 2570},
+		"BenchmarkTCPLatency":     {NsOp: 15000},
+		"BenchmarkNew":            {NsOp: 1},
+	}
+	out := bytes.Buffer{}
+	assert.Equal(t, 2, compare(&out, res, cur, 0.1))
+	assert.Contains(t, out.String(), "SLOWER")
+	assert.Contains(t, out.String(), "ALLOCS")
+}
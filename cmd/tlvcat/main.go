@@ -0,0 +1,261 @@
+// tlvcat does the usual file chores on ToyTLV files, streaming,
+// so the files may be larger than memory:
+//
+//	tlvcat merge a.tlv b.tlv > ab.tlv        concatenates files
+//	tlvcat filter -lit OP [-v] a.tlv > o.tlv  keeps (drops) record types
+//	tlvcat head [-n 10] a.tlv                 the first n records
+//	tlvcat tail [-n 10] a.tlv                 the last n records
+//	tlvcat count a.tlv                        counts records by type
+//	tlvcat split [-mb 64] [-prefix a] a.tlv   cuts into a.0000.tlv ...
+//
+// No file or "-" stands for stdin.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var errStuck = errors.New("can not parse further")
+
+// each feeds all the records of all the files to the callback
+func each(files []string, do func(recs toyqueue.Records) error) error {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		var file io.ReadCloser = os.Stdin
+		if name != "-" {
+			var err error
+			file, err = os.Open(name)
+			if err != nil {
+				return err
+			}
+		}
+		err := feedAll(file, do)
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var errEnough = errors.New("enough")
+
+func feedAll(reader io.Reader, do func(recs toyqueue.Records) error) error {
+	feeder := toytlv.Reader2Feeder{Reader: reader}
+	for {
+		recs, err := feeder.Feed()
+		if len(recs) > 0 {
+			if derr := do(recs); derr != nil {
+				return derr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if len(recs) == 0 {
+			return errStuck
+		}
+	}
+}
+
+func filter(out toyqueue.Drainer, lits string, invert bool) func(recs toyqueue.Records) error {
+	return func(recs toyqueue.Records) error {
+		var keep toyqueue.Records
+		for _, rec := range recs {
+			if (strings.IndexByte(lits, toytlv.Lit(rec)) >= 0) != invert {
+				keep = append(keep, rec)
+			}
+		}
+		return out.Drain(keep)
+	}
+}
+
+func head(out toyqueue.Drainer, n int) func(recs toyqueue.Records) error {
+	return func(recs toyqueue.Records) error {
+		if len(recs) >= n {
+			if err := out.Drain(recs[:n]); err != nil {
+				return err
+			}
+			return errEnough
+		}
+		n -= len(recs)
+		return out.Drain(recs)
+	}
+}
+
+// tail keeps the last n records in a ring buffer
+type tail struct {
+	ring toyqueue.Records
+	pos  int
+}
+
+func (t *tail) add(recs toyqueue.Records) error {
+	for _, rec := range recs {
+		if len(t.ring) < cap(t.ring) {
+			t.ring = append(t.ring, toytlv.Concat(rec))
+			continue
+		}
+		if cap(t.ring) == 0 {
+			break
+		}
+		t.ring[t.pos] = append(t.ring[t.pos][:0], rec...)
+		t.pos = (t.pos + 1) % len(t.ring)
+	}
+	return nil
+}
+
+func (t *tail) records() toyqueue.Records {
+	return append(t.ring[t.pos:], t.ring[:t.pos]...)
+}
+
+type counts map[byte]int
+
+func (c counts) add(recs toyqueue.Records) error {
+	for _, rec := range recs {
+		c[toytlv.Lit(rec)]++
+	}
+	return nil
+}
+
+func (c counts) print(out io.Writer) {
+	lits := make([]byte, 0, len(c))
+	total := 0
+	for lit, n := range c {
+		lits = append(lits, lit)
+		total += n
+	}
+	sort.Slice(lits, func(i, j int) bool { return lits[i] < lits[j] })
+	for _, lit := range lits {
+		_, _ = fmt.Fprintf(out, "%c\t%d\n", lit, c[lit])
+	}
+	_, _ = fmt.Fprintf(out, "total\t%d\n", total)
+}
+
+// splitter writes records into a series of files no bigger than
+// limit bytes (unless a single record is bigger)
+type splitter struct {
+	prefix string
+	limit  int
+	n      int
+	size   int
+	file   *os.File
+	out    toytlv.Writer2Drainer
+}
+
+// add writes the records, as many at once as fit into a file
+func (s *splitter) add(recs toyqueue.Records) error {
+	for len(recs) > 0 {
+		if s.file != nil && s.size+len(recs[0]) > s.limit {
+			if err := s.close(); err != nil {
+				return err
+			}
+		}
+		if s.file == nil {
+			var err error
+			s.file, err = os.Create(fmt.Sprintf("%s.%04d.tlv", s.prefix, s.n))
+			if err != nil {
+				return err
+			}
+			s.out.Writer = s.file
+			s.n++
+			s.size = 0
+		}
+		fit := 1 // even if too big
+		size := len(recs[0])
+		for fit < len(recs) && s.size+size+len(recs[fit]) <= s.limit {
+			size += len(recs[fit])
+			fit++
+		}
+		if err := s.out.Drain(recs[:fit]); err != nil {
+			return err
+		}
+		s.size += size
+		recs = recs[fit:]
+	}
+	return nil
+}
+
+func (s *splitter) close() (err error) {
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	return
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: tlvcat merge|filter|head|tail|count|split [flags] [files]")
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	lits := flags.String("lit", "", "record types to filter")
+	invert := flags.Bool("v", false, "drop the filtered types instead")
+	n := flags.Int("n", 10, "number of records")
+	mb := flags.Int("mb", 64, "max split file size, MB")
+	prefix := flags.String("prefix", "split", "split file name prefix")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *n < 0 {
+		return errors.New("-n must not be negative")
+	}
+	if *mb <= 0 {
+		return errors.New("-mb must be positive")
+	}
+	files := flags.Args()
+	out := &toytlv.Writer2Drainer{Writer: os.Stdout}
+	switch args[0] {
+	case "merge":
+		return each(files, out.Drain)
+	case "filter":
+		return each(files, filter(out, strings.ToUpper(*lits), *invert))
+	case "head":
+		err := each(files, head(out, *n))
+		if errors.Is(err, errEnough) {
+			err = nil
+		}
+		return err
+	case "tail":
+		t := tail{ring: make(toyqueue.Records, 0, *n)}
+		if err := each(files, t.add); err != nil {
+			return err
+		}
+		return out.Drain(t.records())
+	case "count":
+		c := counts{}
+		if err := each(files, c.add); err != nil {
+			return err
+		}
+		c.print(os.Stdout)
+		return nil
+	case "split":
+		s := splitter{prefix: *prefix, limit: *mb << 20}
+		err := each(files, s.add)
+		cerr := s.close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	default:
+		return errors.New("unknown command " + args[0])
+	}
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
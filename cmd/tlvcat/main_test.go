@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testFile(t *testing.T, n int) string {
+	var data []byte
+	for i := 0; i < n; i++ {
+		lit := byte('A' + i%3)
+		data = toytlv.Append(data, lit, []byte{byte(i)})
+	}
+	name := filepath.Join(t.TempDir(), "test.tlv")
+	assert.Nil(t, os.WriteFile(name, data, 0644))
+	return name
+}
+
+type collect struct {
+	recs toyqueue.Records
+}
+
+func (c *collect) Drain(recs toyqueue.Records) error {
+	c.recs = append(c.recs, recs...)
+	return nil
+}
+
+func TestFilterHeadTail(t *testing.T) {
+	name := testFile(t, 30)
+	c := collect{}
+	assert.Nil(t, each([]string{name}, filter(&c, "B", false)))
+	assert.Equal(t, 10, len(c.recs))
+	assert.Equal(t, uint8('B'), toytlv.Lit(c.recs[0]))
+
+	c = collect{}
+	assert.Nil(t, each([]string{name}, filter(&c, "B", true)))
+	assert.Equal(t, 20, len(c.recs))
+
+	c = collect{}
+	assert.ErrorIs(t, each([]string{name, name}, head(&c, 5)), errEnough)
+	assert.Equal(t, 5, len(c.recs))
+
+	tl := tail{ring: make(toyqueue.Records, 0, 4)}
+	assert.Nil(t, each([]string{name}, tl.add))
+	last := tl.records()
+	assert.Equal(t, 4, len(last))
+	assert.Equal(t, toytlv.Record('C', []byte{29}), last[3])
+	assert.Equal(t, toytlv.Record('C', []byte{26}), last[0])
+
+	cnt := counts{}
+	assert.Nil(t, each([]string{name, name}, cnt.add))
+	out := bytes.Buffer{}
+	cnt.print(&out)
+	assert.Equal(t, "A\t20\nB\t20\nC\t20\ntotal\t60\n", out.String())
+}
+
+type broken struct{}
+
+func (b broken) Drain(recs toyqueue.Records) error {
+	return os.ErrClosed
+}
+
+func TestHead_Errors(t *testing.T) {
+	name := testFile(t, 30)
+	assert.ErrorIs(t, each([]string{name}, head(broken{}, 5)), os.ErrClosed)
+	assert.NotNil(t, run([]string{"head", "-n", "-1", name}))
+	assert.NotNil(t, run([]string{"tail", "-n", "-1", name}))
+}
+
+func TestSplit(t *testing.T) {
+	name := testFile(t, 30)
+	prefix := filepath.Join(t.TempDir(), "part")
+	s := splitter{prefix: prefix, limit: 10 * 3}
+	assert.Nil(t, each([]string{name}, s.add))
+	assert.Nil(t, s.close())
+	assert.Equal(t, 3, s.n)
+	var all []byte
+	for i := 0; i < s.n; i++ {
+		part, err := os.ReadFile(fmt.Sprintf("%s.%04d.tlv", prefix, i))
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, len(part), 30)
+		all = append(all, part...)
+	}
+	orig, _ := os.ReadFile(name)
+	assert.Equal(t, orig, all)
+}
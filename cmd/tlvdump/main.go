@@ -0,0 +1,165 @@
+// tlvdump prints ToyTLV files as human-readable text: one line per
+// record, with its offset, header form, type letter, body length and
+// a body preview. Offsets are hex. Records of the types listed in
+// -nest get their bodies expanded as TLV, recursively. A file that
+// ends mid-record is an error.
+//
+//	tlvdump [-nest MN] [-only AB] [-depth 4] [-preview 32] [file ...]
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/learn-decentralized-systems/toytlv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type dumper struct {
+	out     io.Writer
+	nest    string
+	only    string
+	depth   int
+	preview int
+}
+
+var errStuck = errors.New("can not parse further")
+var errTruncated = errors.New("truncated record")
+
+// counter counts the bytes read
+type counter struct {
+	io.Reader
+	n int
+}
+
+func (c *counter) Read(p []byte) (n int, err error) {
+	n, err = c.Reader.Read(p)
+	c.n += n
+	return
+}
+
+func formName(hdrlen int) string {
+	switch hdrlen {
+	case 1:
+		return "tiny"
+	case 2:
+		return "short"
+	default:
+		return "long"
+	}
+}
+
+func preview(body []byte, max int) string {
+	cut := body
+	if len(cut) > max {
+		cut = cut[:max]
+	}
+	ret := ""
+	if utf8.Valid(cut) {
+		ret = strconv.Quote(string(cut))
+	} else {
+		ret = hex.EncodeToString(cut)
+	}
+	if len(cut) < len(body) {
+		ret += "..."
+	}
+	return ret
+}
+
+// record prints a record and, if nested, its children
+func (d *dumper) record(offset int, rec []byte, depth int) {
+	lit, hdrlen, bodylen := toytlv.ProbeHeader(rec)
+	body := rec[hdrlen : hdrlen+bodylen]
+	indent := strings.Repeat("  ", depth)
+	if depth < d.depth && lit != '0' && strings.IndexByte(d.nest, lit) >= 0 {
+		_, _ = fmt.Fprintf(d.out, "%08x %s%-5s %c %d {\n", offset, indent, formName(hdrlen), lit, bodylen)
+		d.nested(offset+hdrlen, body, depth+1)
+		_, _ = fmt.Fprintf(d.out, "%08x %s}\n", offset+len(rec), indent)
+		return
+	}
+	_, _ = fmt.Fprintf(d.out, "%08x %s%-5s %c %d %s\n", offset, indent, formName(hdrlen), lit, bodylen, preview(body, d.preview))
+}
+
+func (d *dumper) nested(offset int, data []byte, depth int) {
+	for len(data) > 0 {
+		lit, rec, rest := toytlv.TakeAnyRecord(data)
+		if lit == 0 || lit == '-' {
+			_, _ = fmt.Fprintf(d.out, "%08x %s! %s\n", offset, strings.Repeat("  ", depth), preview(data, d.preview))
+			return
+		}
+		d.record(offset, rec, depth)
+		offset += len(rec)
+		data = rest
+	}
+}
+
+// dump prints all the records from the reader
+func (d *dumper) dump(reader io.Reader) error {
+	read := counter{Reader: reader}
+	feeder := toytlv.Reader2Feeder{Reader: &read}
+	offset := 0
+	for {
+		recs, err := feeder.Feed()
+		for _, rec := range recs {
+			if d.only == "" || strings.IndexByte(d.only, toytlv.Lit(rec)) >= 0 {
+				d.record(offset, rec, 0)
+			}
+			offset += len(rec)
+		}
+		if err == io.EOF && read.n > offset {
+			return fmt.Errorf("%w at offset %08x", errTruncated, offset)
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("offset %08x: %w", offset, err)
+		} else if len(recs) == 0 {
+			return fmt.Errorf("offset %08x: %w", offset, errStuck)
+		}
+	}
+}
+
+func main() {
+	d := dumper{}
+	flag.StringVar(&d.nest, "nest", "", "record types to expand as nested TLV")
+	flag.StringVar(&d.only, "only", "", "record types to print (top level)")
+	flag.IntVar(&d.depth, "depth", 8, "max nesting depth")
+	flag.IntVar(&d.preview, "preview", 32, "body preview length, bytes")
+	flag.Parse()
+	out := bufio.NewWriter(os.Stdout)
+	d.out = out
+	files := flag.Args()
+	ret := 0
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		var file io.ReadCloser = os.Stdin
+		if name != "-" {
+			var err error
+			file, err = os.Open(name)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				ret = 1
+				continue
+			}
+			if len(files) > 1 {
+				_, _ = fmt.Fprintf(out, "%s:\n", name)
+			}
+		}
+		err := d.dump(file)
+		_ = file.Close()
+		if err != nil {
+			_ = out.Flush()
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			ret = 1
+		}
+	}
+	_ = out.Flush()
+	os.Exit(ret)
+}
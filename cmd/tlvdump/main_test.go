@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"github.com/learn-decentralized-systems/toytlv"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	inner := toytlv.Concat(
+		toytlv.Record('B', []byte("hello")),
+		toytlv.TinyRecord('C', []byte("abc")),
+	)
+	data := toytlv.Concat(
+		toytlv.Record('M', inner),
+		toytlv.Record('X', []byte{0xff, 0, 1}),
+	)
+	out := bytes.Buffer{}
+	d := dumper{out: &out, nest: "M", depth: 8, preview: 4}
+	assert.Nil(t, d.dump(bytes.NewReader(data)))
+	assert.Equal(t,
+		"00000000 short M 11 {\n"+
+			"00000002   short B 5 \"hell\"...\n"+
+			"00000009   tiny  0 3 \"abc\"\n"+
+			"0000000d }\n"+
+			"0000000d short X 3 ff0001\n",
+		out.String())
+
+	out.Reset()
+	d.only = "X"
+	assert.Nil(t, d.dump(bytes.NewReader(data)))
+	assert.Equal(t, "0000000d short X 3 ff0001\n", out.String())
+}
+
+func TestDump_Truncated(t *testing.T) {
+	data := toytlv.Concat(
+		toytlv.Record('A', []byte("whole")),
+		toytlv.Record('B', []byte("cut short"))[:5],
+	)
+	out := bytes.Buffer{}
+	d := dumper{out: &out, depth: 8, preview: 32}
+	err := d.dump(bytes.NewReader(data))
+	assert.ErrorIs(t, err, errTruncated)
+	assert.Equal(t, "truncated record at offset 00000007", err.Error())
+	assert.Equal(t, "00000000 short A 5 \"whole\"\n", out.String())
+}
+
+func TestDump_Tiny(t *testing.T) {
+	data := toytlv.Concat(
+		toytlv.TinyRecord('C', []byte("abc")),
+		toytlv.Record('A', []byte("next")),
+	)
+	out := bytes.Buffer{}
+	d := dumper{out: &out, depth: 8, preview: 32}
+	assert.Nil(t, d.dump(bytes.NewReader(data)))
+	assert.Equal(t,
+		"00000000 tiny  0 3 \"abc\"\n"+
+			"00000004 short A 4 \"next\"\n",
+		out.String())
+}
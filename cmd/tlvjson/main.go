@@ -0,0 +1,95 @@
+// tlvjson converts ToyTLV into JSON and back; one JSON object per
+// top-level record per line, see toytlv.JSONRecord for the format.
+//
+//	tlvjson [-nest MN] < file.tlv > file.json
+//	tlvjson -d < file.json > file.tlv
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/learn-decentralized-systems/toytlv"
+	"io"
+	"os"
+)
+
+// encode converts TLV records into JSON lines
+func encode(out io.Writer, in io.Reader, nest string) error {
+	feeder := toytlv.Reader2Feeder{Reader: in}
+	enc := json.NewEncoder(out)
+	for {
+		recs, err := feeder.Feed()
+		for _, rec := range recs {
+			jrecs, jerr := toytlv.ToJSONRecords(rec, nest)
+			if jerr != nil {
+				return jerr
+			}
+			if jerr = enc.Encode(jrecs[0]); jerr != nil {
+				return jerr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if len(recs) == 0 {
+			return toytlv.ErrBadRecord
+		}
+	}
+}
+
+// decode converts a stream of JSON records (or arrays of records)
+// into TLV
+func decode(out io.Writer, in io.Reader) error {
+	dec := json.NewDecoder(in)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var recs []toytlv.JSONRecord
+		if len(raw) > 0 && raw[0] == '[' {
+			err = json.Unmarshal(raw, &recs)
+		} else {
+			recs = make([]toytlv.JSONRecord, 1)
+			err = json.Unmarshal(raw, &recs[0])
+		}
+		if err != nil {
+			return err
+		}
+		data, err := toytlv.FromJSONRecords(recs)
+		if err != nil {
+			return err
+		}
+		if _, err = out.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	nest := flag.String("nest", "", "record types to convert as nested TLV")
+	back := flag.Bool("d", false, "convert JSON to TLV")
+	flag.Parse()
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	var err error
+	if *back {
+		err = decode(out, in)
+	} else {
+		err = encode(out, in, *nest)
+	}
+	ferr := out.Flush()
+	if err == nil {
+		err = ferr
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"github.com/learn-decentralized-systems/toytlv"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data, err := toytlv.Parse(`M{ b"hi" 1:"1" } B"bye"`)
+	assert.Nil(t, err)
+	js := bytes.Buffer{}
+	assert.Nil(t, encode(&js, bytes.NewReader(data), "M"))
+	assert.Equal(t,
+		`{"lit":"M","form":"long","nested":[{"lit":"B","form":"short","body":"aGk="},{"form":"tiny","body":"MQ=="}]}`+"\n"+
+			`{"lit":"B","form":"long","body":"Ynll"}`+"\n",
+		js.String())
+	back := bytes.Buffer{}
+	assert.Nil(t, decode(&back, &js))
+	assert.Equal(t, data, back.Bytes())
+
+	back.Reset()
+	err = decode(&back, strings.NewReader(`[{"lit":"A","form":"short"},{"lit":"B","form":"short"}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'a', 0, 'b', 0}, back.Bytes())
+}
@@ -0,0 +1,251 @@
+// tlvnet is a netcat for ToyTLV: it listens or connects using
+// TCPDepot, sends the records it reads from stdin and prints the
+// records it receives. Records are in the text notation (see
+// toytlv.Parse), one or more per line, or raw TLV with -raw.
+//
+//	tlvnet -listen :1234 [-echo] [-v]
+//	tlvnet -connect localhost:1234 [-reconnect] [-record session.tlv]
+//	tlvnet -raw -connect localhost:1234 < session.tlv
+//
+// A recorded session is the records sent, as raw TLV, so -raw replays
+// it. With -v, connection events are logged to stderr.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type app struct {
+	raw    bool
+	echo   bool
+	out    io.Writer
+	errs   io.Writer
+	outmx  sync.Mutex
+	record toyqueue.Drainer
+	peers  map[*peer]bool
+	peermx sync.Mutex
+}
+
+// peer is the FeedDrainCloser the Jack makes for every connection
+type peer struct {
+	app    *app
+	addr   string
+	mx     sync.Mutex
+	co     sync.Cond
+	queue  toyqueue.Records
+	closed bool
+}
+
+func (a *app) jack(conn net.Conn) toyqueue.FeedDrainCloser {
+	p := &peer{app: a, addr: conn.RemoteAddr().String()}
+	p.co.L = &p.mx
+	a.peermx.Lock()
+	a.peers[p] = true
+	a.peermx.Unlock()
+	return incoming{p}
+}
+
+// print prints the records received from addr
+func (a *app) print(addr string, recs toyqueue.Records) {
+	a.outmx.Lock()
+	defer a.outmx.Unlock()
+	for _, rec := range recs {
+		if a.raw {
+			_, _ = a.out.Write(rec)
+		} else {
+			_, _ = fmt.Fprintf(a.out, "%s> %s\n", addr, toytlv.Format(rec))
+		}
+	}
+}
+
+// broadcast sends (and records) records to every connected peer;
+// with no peers, the records are dropped with a warning
+func (a *app) broadcast(recs toyqueue.Records) {
+	a.outmx.Lock()
+	if a.record != nil {
+		_ = a.record.Drain(recs)
+	}
+	a.outmx.Unlock()
+	a.peermx.Lock()
+	for p := range a.peers {
+		_ = p.Drain(recs)
+	}
+	n := len(a.peers)
+	a.peermx.Unlock()
+	if n == 0 {
+		_, _ = fmt.Fprintf(a.errs, "no peers connected, %d record(s) dropped\n", len(recs))
+	}
+}
+
+// pending tells whether any outgoing records wait to be sent
+func (a *app) pending() (n int) {
+	a.peermx.Lock()
+	for p := range a.peers {
+		p.mx.Lock()
+		n += len(p.queue)
+		p.mx.Unlock()
+	}
+	a.peermx.Unlock()
+	return
+}
+
+// Drain queues records to be sent to the peer
+func (p *peer) Drain(recs toyqueue.Records) error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if p.closed {
+		return toyqueue.ErrClosed
+	}
+	p.queue = append(p.queue, recs...)
+	p.co.Signal()
+	return nil
+}
+
+// Feed blocks till there is something to send
+func (p *peer) Feed() (recs toyqueue.Records, err error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for len(p.queue) == 0 && !p.closed {
+		p.co.Wait()
+	}
+	if p.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	recs, p.queue = p.queue, nil
+	return
+}
+
+func (p *peer) Close() error {
+	p.mx.Lock()
+	p.closed = true
+	p.co.Broadcast()
+	p.mx.Unlock()
+	p.app.peermx.Lock()
+	delete(p.app.peers, p)
+	p.app.peermx.Unlock()
+	return nil
+}
+
+// Disconnected forgets the peer, its connection is over for good
+func (p *peer) Disconnected() {
+	_ = p.Close()
+}
+
+// incoming prints received records, while outgoing records queue up
+type incoming struct {
+	*peer
+}
+
+func (in incoming) Drain(recs toyqueue.Records) error {
+	in.app.print(in.addr, recs)
+	if in.app.echo {
+		return in.peer.Drain(recs)
+	}
+	return nil
+}
+
+// readInput sends the records from the input to all the peers
+func (a *app) readInput(input io.Reader) error {
+	if a.raw {
+		feeder := toytlv.Reader2Feeder{Reader: input}
+		for {
+			recs, err := feeder.Feed()
+			if len(recs) > 0 {
+				a.broadcast(recs)
+			}
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			} else if len(recs) == 0 {
+				return toytlv.ErrBadRecord
+			}
+		}
+	}
+	lines := bufio.NewScanner(input)
+	for lines.Scan() {
+		data, err := toytlv.Parse(lines.Text())
+		if err != nil {
+			return err
+		}
+		recs, rest, err := toytlv.Split(data)
+		if err == nil && len(rest) > 0 {
+			err = toytlv.ErrIncomplete
+		}
+		if err != nil {
+			return err
+		}
+		a.broadcast(recs)
+	}
+	return lines.Err()
+}
+
+func run() error {
+	listen := flag.String("listen", "", "address to listen at")
+	connect := flag.String("connect", "", "address to connect to")
+	reconnect := flag.Bool("reconnect", false, "reconnect on failure")
+	record := flag.String("record", "", "file to record the records sent to (raw TLV)")
+	linger := flag.Duration("linger", time.Second, "time to wait after the input ends")
+	verbose := flag.Bool("v", false, "log connection events to stderr")
+	a := app{out: os.Stdout, errs: os.Stderr, peers: make(map[*peer]bool)}
+	flag.BoolVar(&a.raw, "raw", false, "raw TLV input/output instead of the text notation")
+	flag.BoolVar(&a.echo, "echo", false, "send back all the received records")
+	flag.Parse()
+	if (*listen == "") == (*connect == "") {
+		return errors.New("either -listen or -connect, please")
+	}
+	if *record != "" {
+		file, err := os.Create(*record)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		a.record = &toytlv.Writer2Drainer{Writer: file}
+	}
+	depot := toytlv.TCPDepot{Reconnect: *reconnect}
+	if *verbose {
+		opts := slog.HandlerOptions{Level: slog.LevelDebug}
+		depot.Logger = slog.New(slog.NewTextHandler(os.Stderr, &opts))
+	}
+	depot.Open(a.jack)
+	defer depot.Close()
+	if *listen != "" {
+		if err := depot.Listen(*listen); err != nil {
+			return err
+		}
+	} else {
+		if err := depot.Connect(*connect); err != nil {
+			return err
+		}
+	}
+	if err := a.readInput(os.Stdin); err != nil {
+		return err
+	}
+	if *listen != "" {
+		select {} // serve till killed
+	}
+	deadline := time.Now().Add(*linger)
+	for a.pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Until(deadline))
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
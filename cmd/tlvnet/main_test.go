@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestApp(t *testing.T) {
+	out, errs, record := bytes.Buffer{}, bytes.Buffer{}, bytes.Buffer{}
+	a := app{
+		out:    &out,
+		errs:   &errs,
+		echo:   true,
+		record: &toytlv.Writer2Drainer{Writer: &record},
+		peers:  make(map[*peer]bool),
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	inout := a.jack(c1)
+
+	err := a.readInput(strings.NewReader("M\"hi\"\nA{ b\"x\" } c\"y\"\n"))
+	assert.Nil(t, err)
+	recs, err := inout.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(recs))
+	assert.Equal(t, `M"hi"`, toytlv.Format(recs[0]))
+
+	err = inout.Drain(toyqueue.Records{toytlv.Record('R', []byte("re"))})
+	assert.Nil(t, err)
+	assert.Equal(t, "pipe> r\"re\"\n", out.String())
+	echoed, err := inout.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(echoed))
+	sent, _ := toytlv.Parse("M\"hi\" A{ b\"x\" } c\"y\"")
+	assert.Equal(t, sent, record.Bytes()) // not the received ones
+
+	assert.Nil(t, inout.Close())
+	_, err = inout.Feed()
+	assert.Equal(t, toyqueue.ErrClosed, err)
+	assert.Equal(t, 0, len(a.peers))
+	assert.Nil(t, a.readInput(strings.NewReader("M\"nobody\"\n")))
+	assert.Equal(t, "no peers connected, 1 record(s) dropped\n", errs.String())
+
+	// a lost connection is no peer either
+	lost := a.jack(c2)
+	assert.Equal(t, 1, len(a.peers))
+	lost.(toytlv.Disconnecter).Disconnected()
+	assert.Equal(t, 0, len(a.peers))
+
+	err = a.readInput(strings.NewReader("M\"unterminated\n"))
+	assert.ErrorIs(t, err, toytlv.ErrBadText)
+}
@@ -0,0 +1,104 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"io"
+	"sync"
+	"time"
+)
+
+// Coalescer is a Nagle-like Drainer: it accumulates small records
+// till either Threshold bytes are pending or Delay has passed since
+// the first pending record, then drains them downstream in one batch.
+// Zero Threshold or Delay means no coalescing, i.e. pass-through.
+// That is a latency vs syscall count trade-off, tunable at any time.
+type Coalescer struct {
+	Drainer   toyqueue.Drainer
+	Threshold int
+	Delay     time.Duration
+
+	mx      sync.Mutex
+	pending toyqueue.Records
+	size    int
+	timer   *time.Timer
+	err     error
+}
+
+// SetLimits adjusts the byte threshold and the max delay on the fly.
+func (c *Coalescer) SetLimits(threshold int, delay time.Duration) {
+	c.mx.Lock()
+	c.Threshold = threshold
+	c.Delay = delay
+	c.mx.Unlock()
+}
+
+func (c *Coalescer) Drain(recs toyqueue.Records) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.pending = append(c.pending, recs...)
+	c.size += TotalLen(recs)
+	if c.size >= c.Threshold || c.Delay <= 0 {
+		return c.flush()
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.Delay, c.timed)
+	}
+	return nil
+}
+
+func (c *Coalescer) timed() {
+	c.mx.Lock()
+	c.timer = nil
+	if c.err == nil {
+		_ = c.flush()
+	}
+	c.mx.Unlock()
+}
+
+func (c *Coalescer) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	recs := c.pending
+	c.pending = nil
+	c.size = 0
+	c.err = c.Drainer.Drain(recs)
+	return c.err
+}
+
+// Pending is the number of records pending.
+func (c *Coalescer) Pending() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.pending)
+}
+
+// Flush drains all the pending records right away. An error from an
+// earlier timed flush gets reported here (or by the next Drain).
+func (c *Coalescer) Flush() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.flush()
+}
+
+// Close flushes, then closes the downstream if it is an io.Closer.
+func (c *Coalescer) Close() error {
+	err := c.Flush()
+	if closer, ok := c.Drainer.(io.Closer); ok {
+		cerr := closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchCounter struct {
+	mx      sync.Mutex
+	batches []toyqueue.Records
+}
+
+func (bc *batchCounter) Drain(recs toyqueue.Records) error {
+	bc.mx.Lock()
+	bc.batches = append(bc.batches, recs)
+	bc.mx.Unlock()
+	return nil
+}
+
+func (bc *batchCounter) count() int {
+	bc.mx.Lock()
+	defer bc.mx.Unlock()
+	return len(bc.batches)
+}
+
+func TestCoalescer(t *testing.T) {
+	bc := batchCounter{}
+	co := Coalescer{
+		Drainer:   &bc,
+		Threshold: 100,
+		Delay:     time.Hour,
+	}
+	rec := Record('A', make([]byte, 30))
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, co.Drain(Join(rec)))
+	}
+	assert.Equal(t, 0, bc.count())
+	assert.Nil(t, co.Drain(Join(rec)))
+	assert.Equal(t, 1, bc.count())
+	assert.Equal(t, 4, len(bc.batches[0]))
+
+	assert.Nil(t, co.Drain(Join(rec)))
+	assert.Nil(t, co.Flush())
+	assert.Equal(t, 2, bc.count())
+
+	co.SetLimits(100, time.Millisecond)
+	assert.Nil(t, co.Drain(Join(rec)))
+	assert.Equal(t, 2, bc.count())
+	assert.Eventually(t, func() bool {
+		return bc.count() == 3
+	}, time.Second, time.Millisecond)
+
+	co.SetLimits(0, 0)
+	assert.Nil(t, co.Drain(Join(rec)))
+	assert.Equal(t, 4, bc.count())
+	assert.Nil(t, co.Close())
+}
@@ -0,0 +1,184 @@
+package toytlv
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"io"
+	"net"
+)
+
+// ZipLit is the record type reserved for compressed blocks.
+// A 'Z' record body is a DEFLATE-compressed concatenation of TLV records.
+// On a zipped stream, an application's own 'Z' records would be taken
+// for blocks; see the README for the list of reserved record types.
+const ZipLit = 'Z'
+
+// MinZipBatch is the least batch size (bytes) worth compressing;
+// smaller batches go through as is. So do the batches that do not
+// get any smaller compressed.
+const MinZipBatch = 512
+
+// MaxZipBlock limits the unpacked size of a block (zip bomb protection)
+const MaxZipBlock = 1 << 26
+
+// ZipDrainer batches records into compressed 'Z' block records.
+// As compressed blocks are flagged by their record type, plain and
+// compressed records can be mixed freely within a stream; UnzipFeeder
+// reads either.
+type ZipDrainer struct {
+	Drainer toyqueue.Drainer
+	// Level is a compress/flate level; 0 stands for the default
+	Level int
+	zip   zipper
+}
+
+// UnzipFeeder unpacks 'Z' blocks, passes other records through.
+type UnzipFeeder struct {
+	Feeder toyqueue.Feeder
+}
+
+type zipper struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func (z *zipper) zip(recs toyqueue.Records, level int) (toyqueue.Records, error) {
+	total := TotalLen(recs)
+	if total < MinZipBatch {
+		return recs, nil
+	}
+	z.buf.Reset()
+	if z.w == nil {
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		w, err := flate.NewWriter(&z.buf, level)
+		if err != nil {
+			return nil, err
+		}
+		z.w = w
+	} else {
+		z.w.Reset(&z.buf)
+	}
+	for _, rec := range recs {
+		_, _ = z.w.Write(rec)
+	}
+	if err := z.w.Close(); err != nil {
+		return nil, err
+	}
+	block := Record(ZipLit, z.buf.Bytes())
+	if len(block) >= total {
+		return recs, nil // incompressible
+	}
+	return toyqueue.Records{block}, nil
+}
+
+// Zip packs records into a single 'Z' block record.
+func Zip(recs toyqueue.Records) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	for _, rec := range recs {
+		_, _ = w.Write(rec)
+	}
+	_ = w.Close()
+	return Record(ZipLit, buf.Bytes())
+}
+
+// Unzip unpacks a 'Z' block record into the records it contains.
+func Unzip(block []byte) (recs toyqueue.Records, err error) {
+	body, rest, err := TakeWary(ZipLit, block)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrBadRecord
+	}
+	r := flate.NewReader(bytes.NewReader(body))
+	data, err := io.ReadAll(io.LimitReader(r, MaxZipBlock+1))
+	_ = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxZipBlock {
+		return nil, ErrBadRecord
+	}
+	recs, rest, err = Split(data)
+	if err == nil && len(rest) != 0 {
+		err = ErrBadRecord
+	}
+	return
+}
+
+func unzipAll(recs toyqueue.Records) (res toyqueue.Records, err error) {
+	for _, rec := range recs {
+		if Lit(rec) != ZipLit {
+			res = append(res, rec)
+			continue
+		}
+		unzipped, err := Unzip(rec)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, unzipped...)
+	}
+	return
+}
+
+func (zd *ZipDrainer) Drain(recs toyqueue.Records) error {
+	zipped, err := zd.zip.zip(recs, zd.Level)
+	if err != nil {
+		return err
+	}
+	return zd.Drainer.Drain(zipped)
+}
+
+func (uf *UnzipFeeder) Feed() (recs toyqueue.Records, err error) {
+	recs, err = uf.Feeder.Feed()
+	if len(recs) == 0 {
+		return
+	}
+	var uerr error
+	recs, uerr = unzipAll(recs)
+	if uerr != nil {
+		err = uerr
+	}
+	return
+}
+
+type zipInOut struct {
+	inout toyqueue.FeedDrainCloser
+	zip   zipper
+}
+
+// ZipJack wraps a Jack to unpack incoming 'Z' blocks and to compress
+// outgoing batches on a TCPConn.
+func ZipJack(jack Jack) Jack {
+	return func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return &zipInOut{inout: jack(conn)}
+	}
+}
+
+func (z *zipInOut) Drain(recs toyqueue.Records) error {
+	unzipped, err := unzipAll(recs)
+	if err != nil {
+		return err
+	}
+	return z.inout.Drain(unzipped)
+}
+
+func (z *zipInOut) Feed() (recs toyqueue.Records, err error) {
+	recs, err = z.inout.Feed()
+	if len(recs) == 0 {
+		return
+	}
+	zipped, zerr := z.zip.zip(recs, 0)
+	if zerr != nil {
+		return nil, zerr
+	}
+	return zipped, err
+}
+
+func (z *zipInOut) Close() error {
+	return z.inout.Close()
+}
@@ -0,0 +1,85 @@
+package toytlv
+
+import (
+	"crypto/rand"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZipDrainer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tlvz")
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	zd := ZipDrainer{
+		Drainer: &Writer2Drainer{Writer: file},
+	}
+	text := []byte("the same old text, over and over again")
+	var batch toyqueue.Records
+	for i := 0; i < 100; i++ {
+		batch = append(batch, Record('T', text))
+	}
+	err = zd.Drain(batch)
+	assert.Nil(t, err)
+	err = zd.Drain(Join(Record('S', []byte("short"))))
+	assert.Nil(t, err)
+	err = zd.Drain(batch)
+	assert.Nil(t, err)
+	info, err := file.Stat()
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(TotalLen(batch)))
+	_ = file.Close()
+
+	file2, err := os.Open(path)
+	assert.Nil(t, err)
+	uf := UnzipFeeder{Feeder: &Reader2Feeder{Reader: file2}}
+	var all toyqueue.Records
+	for err == nil {
+		var recs toyqueue.Records
+		recs, err = uf.Feed()
+		all = append(all, recs...)
+	}
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 201, len(all))
+	for i, rec := range all {
+		lit, body, rest := TakeAny(rec)
+		assert.Equal(t, 0, len(rest))
+		if i == 100 {
+			assert.Equal(t, uint8('S'), lit)
+		} else {
+			assert.Equal(t, uint8('T'), lit)
+			assert.Equal(t, text, body)
+		}
+	}
+	_ = file2.Close()
+}
+
+type lastDrainer struct {
+	recs toyqueue.Records
+}
+
+func (ld *lastDrainer) Drain(recs toyqueue.Records) error {
+	ld.recs = recs
+	return nil
+}
+
+func TestZipDrainer_Incompressible(t *testing.T) {
+	noise := make([]byte, 1000)
+	_, _ = rand.Read(noise)
+	batch := Join(Record('N', noise))
+	last := lastDrainer{}
+	zd := ZipDrainer{Drainer: &last}
+	assert.Nil(t, zd.Drain(batch))
+	assert.Equal(t, batch, last.recs)
+}
+
+func TestUnzipBad(t *testing.T) {
+	_, err := Unzip(Record(ZipLit, []byte("not deflate")))
+	assert.NotNil(t, err)
+	recs, err := Unzip(Zip(Join(Record('A', []byte("a")))))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recs))
+}
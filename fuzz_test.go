@@ -0,0 +1,207 @@
+package toytlv
+
+import (
+	"bytes"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv/tlvtest"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Seeds are in testdata/fuzz; these are common to all the targets.
+func addSeeds(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("3abc"))
+	f.Add([]byte{'a', 1, 'A', '2', 'B', 'B'})
+	f.Add(Concat(Record('M', Record('b', []byte("body"))), []byte{'C', 0, 1, 0, 0}))
+	f.Add([]byte{'X', 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte("!garbage"))
+}
+
+// validPrefix is the longest prefix of data that is complete records
+func validPrefix(data []byte) (prefix []byte) {
+	rest := data
+	for len(rest) > 0 {
+		lit, hdrlen, bodylen := ProbeHeader(rest)
+		if lit == 0 || lit == '-' || hdrlen+bodylen > len(rest) {
+			break
+		}
+		rest = rest[hdrlen+bodylen:]
+	}
+	return data[:len(data)-len(rest)]
+}
+
+func FuzzProbeHeader(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lit, hdrlen, bodylen := ProbeHeader(data)
+		inc := Incomplete(data)
+		switch {
+		case len(data) == 0:
+			if lit != 0 || inc != 1 {
+				t.Fatal("empty input")
+			}
+		case lit == '-':
+			if inc != -1 {
+				t.Fatal("bad record, Incomplete disagrees", inc)
+			}
+		case lit == 0:
+			if inc <= 0 {
+				t.Fatal("incomplete header, Incomplete disagrees", inc)
+			}
+		default:
+			if hdrlen != 1 && hdrlen != 2 && hdrlen != 5 {
+				t.Fatal("bad header length", hdrlen)
+			}
+			if bodylen < 0 || (lit != '0' && (lit < 'A' || lit > 'Z')) {
+				t.Fatal("bad header", lit, bodylen)
+			}
+			want := hdrlen + bodylen - len(data)
+			if want < 0 {
+				want = 0
+			}
+			if inc != want {
+				t.Fatal("Incomplete disagrees", inc, want)
+			}
+		}
+	})
+}
+
+func FuzzSplit(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		recs, rest, err := Split(data)
+		if !bytes.Equal(Concat(append(recs, rest)...), data) {
+			t.Fatal("Split loses bytes")
+		}
+		if err != nil && len(recs) > 0 {
+			t.Fatal("error with records")
+		}
+		if !bytes.Equal(Concat(recs...), validPrefix(data)) {
+			t.Fatal("Split is not greedy")
+		}
+		for _, rec := range recs {
+			lit, whole, left := TakeAnyRecord(rec)
+			if lit == '-' || !bytes.Equal(whole, rec) || len(left) != 0 {
+				t.Fatal("a record is not a record")
+			}
+		}
+	})
+}
+
+func FuzzTake(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lit, body, rest, err := TakeAnyWary(data)
+		plit, hdrlen, bodylen := ProbeHeader(data)
+		if err == nil {
+			if lit != plit || len(body) != bodylen || len(rest)+hdrlen+bodylen != len(data) {
+				t.Fatal("TakeAnyWary disagrees with ProbeHeader")
+			}
+			if lit != '0' {
+				wbody, wrest, werr := TakeWary(lit, data)
+				if werr != nil || !bytes.Equal(wbody, body) || len(wrest) != len(rest) {
+					t.Fatal("TakeWary disagrees with TakeAnyWary")
+				}
+			}
+		} else if (err == ErrBadRecord) != (plit == '-') {
+			t.Fatal("wrong error", err)
+		}
+		rlit, rec, _ := TakeAnyRecord(data)
+		if err == nil && (rlit != lit || len(rec) != len(data)-len(rest)) {
+			t.Fatal("TakeAnyRecord disagrees")
+		}
+		_, _, _ = TakeAny(data)
+		_, _ = TakeRecord('A', data)
+	})
+}
+
+func FuzzAppendTake(f *testing.F) {
+	f.Add(byte('A'), []byte("body"))
+	f.Add(byte('z'), []byte{})
+	f.Add(byte('q'), make([]byte, 300))
+	f.Fuzz(func(t *testing.T, l byte, body []byte) {
+		lit := 'A' + l%26
+		if l&CaseBit != 0 {
+			lit |= CaseBit
+		}
+		rec := Append(nil, lit, body)
+		tlit, tbody, rest, err := TakeAnyWary(rec)
+		if err != nil || len(rest) != 0 || !bytes.Equal(tbody, body) {
+			t.Fatal("round trip fails", err)
+		}
+		if tlit != lit&^CaseBit && !(tlit == '0' && lit&CaseBit != 0 && len(body) < 10) {
+			t.Fatal("wrong type", tlit)
+		}
+	})
+}
+
+func FuzzFeed(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, chunk := range []int{1, 3, 1000} {
+			feeder := Reader2Feeder{
+				Reader: tlvtest.ChunkReader(bytes.NewReader(data), chunk),
+			}
+			var got toyqueue.Records
+			for {
+				recs, err := feeder.Feed()
+				got = append(got, recs...)
+				if err != nil {
+					break
+				}
+				if len(recs) == 0 {
+					t.Fatal("feed makes no progress, chunk", chunk)
+				}
+			}
+			split, _, _ := Split(data)
+			if !bytes.Equal(Concat(got...), validPrefix(data)) || len(got) != len(split) {
+				t.Fatal("feed disagrees with Split, chunk", chunk)
+			}
+		}
+	})
+}
+
+type fuzzSink struct {
+	mx   sync.Mutex
+	recs toyqueue.Records
+}
+
+func (fs *fuzzSink) Drain(recs toyqueue.Records) error {
+	fs.mx.Lock()
+	fs.recs = append(fs.recs, recs...)
+	fs.mx.Unlock()
+	return nil
+}
+
+func (fs *fuzzSink) Feed() (toyqueue.Records, error) {
+	return nil, io.EOF
+}
+
+func (fs *fuzzSink) Close() error {
+	return nil
+}
+
+func FuzzTCPRead(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn, peer := net.Pipe()
+		sink := fuzzSink{}
+		tcp := TCPConn{
+			depot: &TCPDepot{},
+			conn:  conn,
+			inout: &sink,
+		}
+		tcp.wake = sync.NewCond(&tcp.outmx)
+		go func() {
+			_, _ = peer.Write(data)
+			_ = peer.Close()
+		}()
+		_ = tcp.Read()
+		if !bytes.Equal(Concat(sink.recs...), validPrefix(data)) {
+			t.Fatal("TCP read loop disagrees with ProbeHeader")
+		}
+	})
+}
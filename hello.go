@@ -0,0 +1,169 @@
+package toytlv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// HelloLit is the type of the handshake record. The body is nested
+// records: 'P' protocol name, 'V' min and max version (little-endian
+// uint32 each), 'F' feature flags (little-endian uint64), 'N' node ID.
+// Unknown nested records are ignored.
+const HelloLit = 'H'
+
+const MaxHelloLength = 1 << 12
+const HandshakeTimeout = time.Second * 5
+
+var ErrProtocolMismatch = errors.New("handshake: protocol mismatch")
+var ErrVersionMismatch = errors.New("handshake: no common version")
+
+// Hello is what a TCPDepot says when connected, if set. The peers
+// must speak the same protocol and have overlapping version ranges.
+type Hello struct {
+	Protocol   string
+	MinVersion uint32
+	MaxVersion uint32
+	Features   uint64
+	NodeID     []byte
+}
+
+// Handshake is what the two sides agreed upon.
+type Handshake struct {
+	Protocol string
+	// Version is the highest version both sides speak
+	Version uint32
+	// Features are the flags both sides have
+	Features uint64
+	PeerID   []byte
+}
+
+// Record makes the handshake record.
+func (h *Hello) Record() []byte {
+	var ver [8]byte
+	binary.LittleEndian.PutUint32(ver[:4], h.MinVersion)
+	binary.LittleEndian.PutUint32(ver[4:], h.MaxVersion)
+	var feat [8]byte
+	binary.LittleEndian.PutUint64(feat[:], h.Features)
+	return Record(HelloLit,
+		Record('P', []byte(h.Protocol)),
+		Record('V', ver[:]),
+		Record('F', feat[:]),
+		Record('N', h.NodeID),
+	)
+}
+
+// ParseHello parses a handshake record, a short or long 'H' one;
+// a tiny record has no type to tell a hello by.
+func ParseHello(rec []byte) (hello Hello, err error) {
+	if lit, _, _ := ProbeHeader(rec); lit != HelloLit {
+		return hello, ErrBadRecord
+	}
+	body, rest, err := TakeWary(HelloLit, rec)
+	if err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		return hello, ErrBadRecord
+	}
+	for len(body) > 0 {
+		var lit byte
+		var field []byte
+		lit, field, body, err = TakeAnyWary(body)
+		if err != nil {
+			return
+		}
+		switch lit {
+		case 'P':
+			hello.Protocol = string(field)
+		case 'V':
+			if len(field) != 8 {
+				return hello, ErrBadRecord
+			}
+			hello.MinVersion = binary.LittleEndian.Uint32(field[:4])
+			hello.MaxVersion = binary.LittleEndian.Uint32(field[4:])
+			if hello.MinVersion > hello.MaxVersion {
+				return hello, ErrBadRecord
+			}
+		case 'F':
+			if len(field) != 8 {
+				return hello, ErrBadRecord
+			}
+			hello.Features = binary.LittleEndian.Uint64(field)
+		case 'N':
+			hello.NodeID = append([]byte(nil), field...)
+		}
+	}
+	return
+}
+
+// Negotiate checks the peer's hello against ours. A version range
+// with the min above the max matches nothing.
+func (h *Hello) Negotiate(peer *Hello) (*Handshake, error) {
+	if h.Protocol != peer.Protocol {
+		return nil, ErrProtocolMismatch
+	}
+	if h.MinVersion > h.MaxVersion || peer.MinVersion > peer.MaxVersion {
+		return nil, ErrVersionMismatch
+	}
+	version := h.MaxVersion
+	if peer.MaxVersion < version {
+		version = peer.MaxVersion
+	}
+	if version < h.MinVersion || version < peer.MinVersion {
+		return nil, ErrVersionMismatch
+	}
+	return &Handshake{
+		Protocol: h.Protocol,
+		Version:  version,
+		Features: h.Features & peer.Features,
+		PeerID:   peer.NodeID,
+	}, nil
+}
+
+// ReadRecord reads exactly one record, not a byte more.
+func ReadRecord(reader io.Reader, maxlen int) (rec []byte, err error) {
+	for {
+		need := Incomplete(rec)
+		if need == 0 {
+			return rec, nil
+		}
+		if need < 0 || len(rec)+need > maxlen {
+			return nil, ErrBadRecord
+		}
+		more := make([]byte, need)
+		if _, err = io.ReadFull(reader, more); err != nil {
+			return nil, err
+		}
+		rec = append(rec, more...)
+	}
+}
+
+// handshake exchanges hellos, if the depot has one
+func (de *TCPDepot) handshake(conn net.Conn) (*Handshake, error) {
+	if de.Hello == nil {
+		return nil, nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	written := make(chan error, 1)
+	go func() { // net.Pipe writes block
+		_, err := conn.Write(de.Hello.Record())
+		written <- err
+	}()
+	rec, err := ReadRecord(conn, MaxHelloLength)
+	if err != nil {
+		_ = conn.Close() // no waiting for the write to time out
+		return nil, err
+	}
+	if err = <-written; err != nil {
+		return nil, err
+	}
+	peer, err := ParseHello(rec)
+	if err != nil {
+		return nil, err
+	}
+	return de.Hello.Negotiate(&peer)
+}
@@ -0,0 +1,126 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHello_Negotiate(t *testing.T) {
+	a := Hello{Protocol: "toy", MinVersion: 1, MaxVersion: 3, Features: 0b1011, NodeID: []byte("alice")}
+	b, err := ParseHello(a.Record())
+	assert.Nil(t, err)
+	assert.Equal(t, a, b)
+
+	b.MaxVersion = 2
+	b.Features = 0b0110
+	b.NodeID = []byte("bob")
+	shake, err := a.Negotiate(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, &Handshake{Protocol: "toy", Version: 2, Features: 0b0010, PeerID: []byte("bob")}, shake)
+
+	b.MinVersion, b.MaxVersion = 4, 5
+	_, err = a.Negotiate(&b)
+	assert.Equal(t, ErrVersionMismatch, err)
+	b.Protocol = "other"
+	_, err = a.Negotiate(&b)
+	assert.Equal(t, ErrProtocolMismatch, err)
+
+	_, err = ParseHello(Record(HelloLit, Record('V', []byte{1})))
+	assert.Equal(t, ErrBadRecord, err)
+
+	// inverted ranges
+	b = Hello{Protocol: "toy", MinVersion: 3, MaxVersion: 1}
+	_, err = ParseHello(b.Record())
+	assert.Equal(t, ErrBadRecord, err)
+	_, err = a.Negotiate(&b)
+	assert.Equal(t, ErrVersionMismatch, err)
+	_, err = b.Negotiate(&a)
+	assert.Equal(t, ErrVersionMismatch, err)
+}
+
+func TestTCPDepot_Handshake(t *testing.T) {
+	mem := MemNet{}
+	var jacked int32
+	jack := func(conn net.Conn) toyqueue.FeedDrainCloser {
+		atomic.AddInt32(&jacked, 1)
+		return newTestPeer(false)
+	}
+	server := TCPDepot{Net: &mem, Hello: &Hello{Protocol: "toy", MinVersion: 1, MaxVersion: 2, NodeID: []byte{1}}}
+	server.Open(jack)
+	assert.Nil(t, server.Listen("server"))
+	defer server.Close()
+
+	client := TCPDepot{Net: &mem, Hello: &Hello{Protocol: "toy", MinVersion: 2, MaxVersion: 5, NodeID: []byte{2}}}
+	client.Open(jack)
+	defer client.Close()
+	assert.Nil(t, client.Connect("server"))
+	shake := client.Conn("server").Handshake()
+	assert.Equal(t, uint32(2), shake.Version)
+	assert.Equal(t, []byte{1}, shake.PeerID)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&jacked) == 2
+	}, time.Second, time.Millisecond)
+
+	client.Hello.MinVersion = 3
+	assert.Equal(t, ErrVersionMismatch, client.Connect("server"))
+	time.Sleep(time.Millisecond * 10)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&jacked))
+}
+
+func TestTCPDepot_PeerKey(t *testing.T) {
+	mem := MemNet{}
+	depots := [2]*TCPDepot{}
+	for i := range depots {
+		i := i
+		depots[i] = &TCPDepot{Net: &mem, Hello: &Hello{Protocol: "toy", MaxVersion: 1, NodeID: []byte{byte(i + 1)}}}
+		depots[i].Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+			return newTestPeer(false)
+		})
+		assert.Nil(t, depots[i].Listen("node"+strconv.Itoa(i)))
+		defer depots[i].Close()
+	}
+	// connect both ways; the connection made by the lesser ID stays
+	assert.Nil(t, depots[0].Connect("node1"))
+	assert.Nil(t, depots[1].Connect("node0"))
+	key0, key1 := PeerKey([]byte{1}), PeerKey([]byte{2})
+	assert.Equal(t, "01", key0)
+	assert.Eventually(t, func() bool {
+		a, b := depots[0].Conn(key1), depots[1].Conn(key0)
+		return a != nil && b != nil && a.outbound && !b.outbound
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "node1", depots[0].Conn(key1).addr)
+	assert.Equal(t, depots[0].Conn(key1), depots[0].Conn("node1"))
+	// the address of the connection that lost leads to the one that stays
+	assert.Equal(t, depots[1].Conn(key0), depots[1].Conn("node0"))
+
+	hi := toyqueue.Records{Record('A', []byte("hi"))}
+	depots[0].Conn(key1).inout.(*testPeer).Send(hi)
+	assert.Nil(t, depots[1].DrainToPeer(nil, []byte{1}))
+	assert.Equal(t, hi, depots[1].Conn(key0).inout.(*testPeer).Received(1))
+	assert.Equal(t, ErrAddressUnknown, depots[1].DrainToPeer(nil, []byte{3}))
+}
+
+func TestParseHello_Tiny(t *testing.T) {
+	_, err := ParseHello(TinyRecord('H', nil))
+	assert.Equal(t, ErrBadRecord, err)
+	_, err = ParseHello(Record('H'))
+	assert.Nil(t, err)
+}
+
+func TestTCPDepot_HandshakeBadHello(t *testing.T) {
+	// the peer says garbage and reads nothing: no waiting for the
+	// hello to be written
+	de := TCPDepot{Hello: &Hello{Protocol: "toy", MaxVersion: 1}}
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() { _, _ = b.Write([]byte("!")) }()
+	start := time.Now()
+	_, err := de.handshake(a)
+	assert.Equal(t, ErrBadRecord, err)
+	assert.Less(t, time.Since(start), HandshakeTimeout/2)
+}
@@ -0,0 +1,136 @@
+package toytlv
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// JSONRecord is the JSON representation of a ToyTLV record, e.g.
+//
+//	{"lit":"M","form":"long","nested":[{"form":"tiny","body":"YWJj"}]}
+//
+// Form is one of "tiny", "short" or "long"; tiny records have no
+// letter. The body is base64 (the default for []byte), or nested
+// records for the types declared nested, unless the body is not
+// valid TLV.
+type JSONRecord struct {
+	Lit    string       `json:"lit,omitempty"`
+	Form   string       `json:"form"`
+	Body   []byte       `json:"body,omitempty"`
+	Nested []JSONRecord `json:"nested,omitempty"`
+}
+
+const (
+	FormTiny  = "tiny"
+	FormShort = "short"
+	FormLong  = "long"
+)
+
+var ErrBadJSON = errors.New("bad TLV JSON record")
+
+func formOf(hdrlen int) string {
+	switch hdrlen {
+	case 1:
+		return FormTiny
+	case 2:
+		return FormShort
+	default:
+		return FormLong
+	}
+}
+
+// ToJSONRecords converts TLV records into their JSON representation;
+// bodies of the types listed in nest get converted recursively.
+func ToJSONRecords(data []byte, nest string) (recs []JSONRecord, err error) {
+	for len(data) > 0 {
+		lit, hdrlen, bodylen := ProbeHeader(data)
+		if lit == '-' {
+			return nil, ErrBadRecord
+		}
+		if lit == 0 || hdrlen+bodylen > len(data) {
+			return nil, ErrIncomplete
+		}
+		rec := JSONRecord{Form: formOf(hdrlen)}
+		body := data[hdrlen : hdrlen+bodylen]
+		if lit != '0' {
+			rec.Lit = string(lit)
+		}
+		if lit != '0' && len(body) > 0 && strings.IndexByte(nest, lit) >= 0 {
+			rec.Nested, _ = ToJSONRecords(body, nest)
+		}
+		if rec.Nested == nil {
+			rec.Body = body // not nested or not TLV after all
+		}
+		recs = append(recs, rec)
+		data = data[hdrlen+bodylen:]
+	}
+	return
+}
+
+// FromJSONRecords converts JSON-represented records into TLV bytes,
+// header forms preserved.
+func FromJSONRecords(recs []JSONRecord) (data []byte, err error) {
+	for _, rec := range recs {
+		data, err = AppendJSONRecord(data, rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// AppendJSONRecord appends a JSON-represented record as TLV bytes.
+func AppendJSONRecord(into []byte, rec JSONRecord) (res []byte, err error) {
+	body := rec.Body
+	if len(rec.Nested) > 0 {
+		if len(body) > 0 {
+			return into, ErrBadJSON
+		}
+		body, err = FromJSONRecords(rec.Nested)
+		if err != nil {
+			return into, err
+		}
+	}
+	var lit byte
+	if len(rec.Lit) == 1 {
+		lit = rec.Lit[0] &^ CaseBit
+	}
+	switch {
+	case rec.Form == FormTiny && rec.Lit == "" && len(body) <= 9:
+		res = append(into, '0'+byte(len(body)))
+	case rec.Form == FormShort && lit >= 'A' && lit <= 'Z' && len(body) <= 0xff:
+		res = append(into, lit|CaseBit, byte(len(body)))
+	case rec.Form == FormLong && lit >= 'A' && lit <= 'Z' && len(body) <= 0x7fffffff:
+		var bookmark int
+		bookmark, res = OpenHeader(into, lit)
+		res = append(res, body...)
+		CloseHeader(res, bookmark)
+		return res, nil
+	default:
+		return into, ErrBadJSON
+	}
+	return append(res, body...), nil
+}
+
+// TLV2JSON converts TLV records into a JSON array.
+func TLV2JSON(data []byte, nest string) ([]byte, error) {
+	recs, err := ToJSONRecords(data, nest)
+	if err != nil {
+		return nil, err
+	}
+	if recs == nil {
+		recs = []JSONRecord{}
+	}
+	return json.Marshal(recs)
+}
+
+// JSON2TLV converts a JSON array of records into TLV bytes.
+func JSON2TLV(js []byte) ([]byte, error) {
+	var recs []JSONRecord
+	err := json.Unmarshal(js, &recs)
+	if err != nil {
+		return nil, err
+	}
+	return FromJSONRecords(recs)
+}
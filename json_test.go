@@ -0,0 +1,38 @@
+package toytlv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTLV2JSON(t *testing.T) {
+	data, err := Parse(`M{ B"hi" 3:"abc" } x"\xff"`)
+	assert.Nil(t, err)
+	js, err := TLV2JSON(data, "M")
+	assert.Nil(t, err)
+	assert.Equal(t,
+		`[{"lit":"M","form":"long","nested":[{"lit":"B","form":"long","body":"aGk="},`+
+			`{"form":"tiny","body":"YWJj"}]},{"lit":"X","form":"short","body":"/w=="}]`,
+		string(js))
+	back, err := JSON2TLV(js)
+	assert.Nil(t, err)
+	assert.Equal(t, data, back)
+
+	// not really nested
+	bad, err := Parse(`M{ B"ok" } M"!"`)
+	assert.Nil(t, err)
+	js, err = TLV2JSON(bad, "M")
+	assert.Nil(t, err)
+	assert.Equal(t,
+		`[{"lit":"M","form":"long","nested":[{"lit":"B","form":"long","body":"b2s="}]},`+
+			`{"lit":"M","form":"long","body":"IQ=="}]`,
+		string(js))
+	back, err = JSON2TLV(js)
+	assert.Nil(t, err)
+	assert.Equal(t, bad, back)
+
+	_, err = JSON2TLV([]byte(`[{"lit":"m","form":"tiny"}]`))
+	assert.Equal(t, ErrBadJSON, err)
+	_, err = TLV2JSON([]byte("M"), "")
+	assert.Equal(t, ErrIncomplete, err)
+}
@@ -0,0 +1,326 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"net"
+	"sync"
+)
+
+// The customary lanes, the most urgent first.
+const (
+	LaneControl = iota
+	LaneInteractive
+	LaneBulk
+)
+
+// DefaultLaneBatch is the default limit of a Lanes.Feed batch, bytes
+const DefaultLaneBatch = 1 << 16
+
+// DefaultLaneQueue is the default limit of the bytes queued in Lanes
+const DefaultLaneQueue = 1 << 20
+
+// MaxLanes is the number of lanes; a lane past the last one is the
+// last one
+const MaxLanes = 16
+
+// Lanes is a priority-aware outbound queue: records go into lanes,
+// Feed takes them out in the order of priority, in limited batches,
+// so urgent records overtake a backlog of bulk ones. With no Weights,
+// the priority is strict: lane 0 first, then lane 1, etc. With
+// Weights, lanes are served by weighted deficit round robin.
+type Lanes struct {
+	// Classify picks the lane of a record for Drain; nil means
+	// everything goes to LaneBulk
+	Classify func(rec []byte) int
+	// Weights, if set, are the bytes a lane may send per round;
+	// lanes with no weight get the least weight
+	Weights []int
+	// Batch limits the bytes a Feed returns, DefaultLaneBatch if 0
+	Batch int
+	// MaxQueued limits the bytes queued in all the lanes together,
+	// DefaultLaneQueue if 0; Drain waits for Feed to make room
+	MaxQueued int
+
+	mx      sync.Mutex
+	co      sync.Cond
+	lanes   []toyqueue.Records
+	deficit []int
+	cur     int
+	size    int
+	entered bool
+	closed  bool
+}
+
+type laneDrainer struct {
+	lanes *Lanes
+	lane  int
+}
+
+// Lane returns the Drainer of a lane.
+func (l *Lanes) Lane(lane int) toyqueue.Drainer {
+	return laneDrainer{lanes: l, lane: lane}
+}
+
+func (ld laneDrainer) Drain(recs toyqueue.Records) error {
+	return ld.lanes.put(ld.lane, recs)
+}
+
+func (l *Lanes) put(lane int, recs toyqueue.Records) error {
+	if lane < 0 {
+		lane = 0
+	} else if lane >= MaxLanes {
+		lane = MaxLanes - 1
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.co.L == nil {
+		l.co.L = &l.mx
+	}
+	max := l.MaxQueued
+	if max <= 0 {
+		max = DefaultLaneQueue
+	}
+	size := TotalLen(recs)
+	for l.size > 0 && l.size+size > max && !l.closed {
+		l.co.Wait()
+	}
+	if l.closed {
+		return toyqueue.ErrClosed
+	}
+	l.size += size
+	for len(l.lanes) <= lane {
+		l.lanes = append(l.lanes, nil)
+		l.deficit = append(l.deficit, 0)
+	}
+	l.lanes[lane] = append(l.lanes[lane], recs...)
+	l.co.Broadcast()
+	return nil
+}
+
+// Drain puts the records into lanes, see Classify.
+func (l *Lanes) Drain(recs toyqueue.Records) error {
+	if l.Classify == nil {
+		return l.put(LaneBulk, recs)
+	}
+	for len(recs) > 0 {
+		lane := l.Classify(recs[0])
+		n := 1
+		for n < len(recs) && l.Classify(recs[n]) == lane {
+			n++
+		}
+		if err := l.put(lane, recs[:n]); err != nil {
+			return err
+		}
+		recs = recs[n:]
+	}
+	return nil
+}
+
+func (l *Lanes) weight(lane int) int {
+	least := 0
+	for _, w := range l.Weights {
+		if least == 0 || (w > 0 && w < least) {
+			least = w
+		}
+	}
+	if lane < len(l.Weights) && l.Weights[lane] > 0 {
+		return l.Weights[lane]
+	}
+	if least <= 0 {
+		return 1
+	}
+	return least
+}
+
+func (l *Lanes) pending() bool {
+	for _, lane := range l.lanes {
+		if len(lane) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Len is the number of records in all the lanes.
+func (l *Lanes) Len() (n int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for _, lane := range l.lanes {
+		n += len(lane)
+	}
+	return
+}
+
+// Feed returns the next batch, waiting for records as needed.
+func (l *Lanes) Feed() (recs toyqueue.Records, err error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.co.L == nil {
+		l.co.L = &l.mx
+	}
+	for !l.pending() && !l.closed {
+		l.co.Wait()
+	}
+	if !l.pending() {
+		return nil, toyqueue.ErrClosed
+	}
+	batch := l.Batch
+	if batch <= 0 {
+		batch = DefaultLaneBatch
+	}
+	if l.Weights == nil {
+		recs = l.strict(batch)
+	} else {
+		recs = l.fair(batch)
+	}
+	l.size -= TotalLen(recs)
+	l.co.Broadcast()
+	return recs, nil
+}
+
+func (l *Lanes) strict(batch int) (recs toyqueue.Records) {
+	total := 0
+	for i := range l.lanes {
+		lane := l.lanes[i]
+		n := 0
+		for n < len(lane) && (total == 0 || total+len(lane[n]) <= batch) {
+			total += len(lane[n])
+			n++
+		}
+		recs = append(recs, lane[:n]...)
+		l.lanes[i] = lane[n:]
+		if n < len(lane) {
+			break
+		}
+	}
+	return
+}
+
+// skip adds the weights of the rounds in which no lane could send
+// anything, all at once, so a big record does not take a loop of
+// rounds to come through
+func (l *Lanes) skip() {
+	rounds := -1
+	for i, lane := range l.lanes {
+		if len(lane) == 0 {
+			continue
+		}
+		need := len(lane[0]) - l.deficit[i]
+		if need <= 0 {
+			return
+		}
+		w := l.weight(i)
+		if r := (need + w - 1) / w; rounds < 0 || r < rounds {
+			rounds = r
+		}
+	}
+	if rounds <= 1 {
+		return
+	}
+	for i, lane := range l.lanes {
+		if len(lane) > 0 {
+			l.deficit[i] += (rounds - 1) * l.weight(i)
+		}
+	}
+}
+
+func (l *Lanes) fair(batch int) (recs toyqueue.Records) {
+	total := 0
+	for total < batch && l.pending() {
+		i := l.cur
+		lane := l.lanes[i]
+		if len(lane) == 0 {
+			l.deficit[i] = 0
+		} else {
+			if !l.entered {
+				l.skip()
+				l.deficit[i] += l.weight(i)
+				l.entered = true
+			}
+			n := 0
+			for n < len(lane) && len(lane[n]) <= l.deficit[i] && total < batch {
+				l.deficit[i] -= len(lane[n])
+				total += len(lane[n])
+				n++
+			}
+			recs = append(recs, lane[:n]...)
+			l.lanes[i] = lane[n:]
+			if total >= batch && n < len(lane) {
+				break // resume this lane next time
+			}
+		}
+		l.cur = (i + 1) % len(l.lanes)
+		l.entered = false
+	}
+	return
+}
+
+// Close makes Drain return ErrClosed; so does Feed, once the lanes
+// are empty.
+func (l *Lanes) Close() error {
+	l.mx.Lock()
+	if l.co.L == nil {
+		l.co.L = &l.mx
+	}
+	l.closed = true
+	l.co.Broadcast()
+	l.mx.Unlock()
+	return nil
+}
+
+type lanesInout struct {
+	inner toyqueue.FeedDrainCloser
+	lanes *Lanes
+}
+
+// LanesJack sends the jack's output through the Lanes made by lanes(),
+// one Lanes per connection. See also TCPDepot.Lanes.
+func LanesJack(jack Jack, lanes func(conn net.Conn) *Lanes) Jack {
+	return func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newLanesInout(jack(conn), lanes(conn))
+	}
+}
+
+func newLanesInout(inner toyqueue.FeedDrainCloser, lanes *Lanes) *lanesInout {
+	li := &lanesInout{inner: inner, lanes: lanes}
+	go li.pump()
+	return li
+}
+
+func (li *lanesInout) pump() {
+	for {
+		recs, err := li.inner.Feed()
+		if len(recs) > 0 && li.lanes.Drain(recs) != nil {
+			return
+		}
+		if err != nil {
+			_ = li.lanes.Close()
+			return
+		}
+	}
+}
+
+func (li *lanesInout) Drain(recs toyqueue.Records) error {
+	return li.inner.Drain(recs)
+}
+
+func (li *lanesInout) Feed() (toyqueue.Records, error) {
+	return li.lanes.Feed()
+}
+
+func (li *lanesInout) Close() error {
+	_ = li.lanes.Close()
+	return li.inner.Close()
+}
+
+func (li *lanesInout) Reconnected(conn net.Conn) {
+	if re, ok := li.inner.(Reconnecter); ok {
+		re.Reconnected(conn)
+	}
+}
+
+func (li *lanesInout) Disconnected() {
+	if dis, ok := li.inner.(Disconnecter); ok {
+		dis.Disconnected()
+	}
+}
@@ -0,0 +1,161 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLanes_Strict(t *testing.T) {
+	lanes := Lanes{Batch: 1000}
+	bulk := Record('B', make([]byte, 300))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, lanes.Lane(LaneBulk).Drain(toyqueue.Records{bulk}))
+	}
+	recs, err := lanes.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(recs))
+	ping := Record('P', []byte("ping"))
+	assert.Nil(t, lanes.Lane(LaneControl).Drain(toyqueue.Records{ping}))
+	recs, err = lanes.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, ping, recs[0])
+	assert.Equal(t, 1+3, len(recs))
+
+	assert.Nil(t, lanes.Close())
+	assert.Equal(t, toyqueue.ErrClosed, lanes.Lane(0).Drain(nil))
+	n := 0
+	for ; err == nil; recs, err = lanes.Feed() {
+		n += len(recs)
+	}
+	assert.Equal(t, 4+4, n)
+	assert.Equal(t, toyqueue.ErrClosed, err)
+}
+
+func TestLanes_Fair(t *testing.T) {
+	lanes := Lanes{
+		Weights: []int{400, 200},
+		Batch:   4 * 6 * 97, // 4 rounds of 4+2 records
+		Classify: func(rec []byte) int {
+			if Lit(rec) == 'C' {
+				return LaneControl
+			}
+			return LaneInteractive
+		},
+	}
+	var recs toyqueue.Records
+	for i := 0; i < 20; i++ {
+		recs = append(recs, Record('C', make([]byte, 95)), Record('I', make([]byte, 95)))
+	}
+	assert.Nil(t, lanes.Drain(recs))
+	out, err := lanes.Feed()
+	assert.Nil(t, err)
+	counts := map[byte]int{}
+	for _, rec := range out {
+		counts[Lit(rec)]++
+	}
+	assert.Equal(t, 24, len(out))
+	assert.Equal(t, 16, counts['C'])
+	assert.Equal(t, 8, counts['I'])
+}
+
+func TestLanesJack(t *testing.T) {
+	inner := newTestPeer(false)
+	jack := LanesJack(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return inner
+	}, func(conn net.Conn) *Lanes {
+		return &Lanes{Classify: func(rec []byte) int {
+			if Lit(rec) == 'P' {
+				return LaneControl
+			}
+			return LaneBulk
+		}}
+	})
+	inout := jack(nil)
+	ping := Record('P', []byte("ping"))
+	inner.Send(toyqueue.Records{Record('B', []byte("bulk")), ping})
+	var got toyqueue.Records
+	for len(got) < 2 {
+		recs, err := inout.Feed()
+		assert.Nil(t, err)
+		got = append(got, recs...)
+	}
+	assert.Nil(t, inout.Drain(toyqueue.Records{ping}))
+	assert.Equal(t, toyqueue.Records{ping}, inner.Received(1))
+	assert.Nil(t, inout.Close())
+	_, err := inout.Feed()
+	assert.Equal(t, toyqueue.ErrClosed, err)
+}
+
+func TestLanes_Clamp(t *testing.T) {
+	lanes := Lanes{}
+	assert.Nil(t, lanes.Lane(1<<30).Drain(toyqueue.Records{Record('B', nil)}))
+	assert.Equal(t, MaxLanes, len(lanes.lanes))
+}
+
+func TestLanes_FairBig(t *testing.T) {
+	lanes := Lanes{Weights: []int{1, 1}, MaxQueued: 1 << 21}
+	big := Record('B', make([]byte, 1<<20))
+	assert.Nil(t, lanes.Lane(1).Drain(toyqueue.Records{big}))
+	assert.Nil(t, lanes.Lane(0).Drain(toyqueue.Records{Record('C', make([]byte, 1<<19))}))
+	recs, err := lanes.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recs))
+	assert.Equal(t, byte('C'), Lit(recs[0]))
+	recs, err = lanes.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, toyqueue.Records{big}, recs)
+}
+
+func TestTCPDepot_Lanes(t *testing.T) {
+	mem := MemNet{}
+	server := newTestPeer(false)
+	depot := TCPDepot{Net: &mem, Lanes: func(conn net.Conn) *Lanes {
+		return &Lanes{}
+	}}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		if conn.RemoteAddr().String() == "server" {
+			return newTestPeer(false)
+		}
+		return server
+	})
+	defer depot.Close()
+	assert.Nil(t, depot.Listen("server"))
+	assert.Nil(t, depot.Connect("server"))
+	var tcp *TCPConn
+	assert.Eventually(t, func() bool {
+		tcp = depot.Conn("server")
+		return tcp != nil
+	}, time.Second, time.Millisecond)
+	ping := Record('P', []byte("ping"))
+	assert.Nil(t, tcp.Lanes().Lane(LaneControl).Drain(toyqueue.Records{ping}))
+	assert.Equal(t, toyqueue.Records{ping}, server.Received(1))
+}
+
+func TestLanes_MaxQueued(t *testing.T) {
+	lanes := Lanes{MaxQueued: 1000, Batch: 1000}
+	rec := Record('B', make([]byte, 600))
+	assert.Nil(t, lanes.Drain(toyqueue.Records{rec}))
+	done := make(chan error)
+	go func() {
+		done <- lanes.Drain(toyqueue.Records{rec})
+	}()
+	select {
+	case <-done:
+		t.Fatal("no backpressure")
+	case <-time.After(time.Millisecond * 20):
+	}
+	recs, err := lanes.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recs))
+	assert.Nil(t, <-done)
+	// a waiting Drain fails once closed
+	go func() {
+		done <- lanes.Drain(toyqueue.Records{rec})
+	}()
+	time.Sleep(time.Millisecond * 10)
+	assert.Nil(t, lanes.Close())
+	assert.Equal(t, toyqueue.ErrClosed, <-done)
+}
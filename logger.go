@@ -0,0 +1,76 @@
+package toytlv
+
+import (
+	"context"
+	"errors"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// The kinds of errors, as logged
+const (
+	KindParse     = "parse"
+	KindHandshake = "handshake"
+	KindTimeout   = "timeout"
+	KindClosed    = "closed"
+	KindInout     = "inout"
+	KindIO        = "io"
+)
+
+// ErrKind classifies an error for the log.
+func ErrKind(err error) string {
+	switch {
+	case errors.Is(err, ErrBadRecord):
+		return KindParse
+	case errors.Is(err, ErrProtocolMismatch), errors.Is(err, ErrVersionMismatch):
+		return KindHandshake
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return KindTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, io.ErrClosedPipe), errors.Is(err, ErrDisconnected),
+		errors.Is(err, toyqueue.ErrClosed):
+		return KindClosed
+	default:
+		return KindIO
+	}
+}
+
+// level: a peer going away is routine, a peer talking garbage is not
+func level(kind string) slog.Level {
+	switch kind {
+	case KindClosed:
+		return slog.LevelDebug
+	case KindParse, KindHandshake:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// log logs a depot event, if the depot has a Logger
+func (de *TCPDepot) log(lvl slog.Level, msg string, args ...any) {
+	if de.Logger != nil {
+		de.Logger.Log(context.Background(), lvl, msg, args...)
+	}
+}
+
+// log logs a connection event, adding the address and the direction
+// of the connection
+func (tcp *TCPConn) log(lvl slog.Level, msg string, args ...any) {
+	if tcp.depot.Logger != nil {
+		args = append([]any{"addr", tcp.addr, "outbound", tcp.outbound}, args...)
+		tcp.depot.log(lvl, msg, args...)
+	}
+}
+
+// logErr logs a failed read or write
+func (tcp *TCPConn) logErr(dir Direction, kind string, offset int64, err error) {
+	msg := "read failed"
+	if dir == Outbound {
+		msg = "write failed"
+	}
+	tcp.log(level(kind), msg, "dir", dir.String(), "kind", kind, "offset", offset, "err", err)
+}
@@ -0,0 +1,123 @@
+package toytlv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestErrKind(t *testing.T) {
+	assert.Equal(t, KindParse, ErrKind(ErrBadRecord))
+	assert.Equal(t, KindHandshake, ErrKind(ErrVersionMismatch))
+	assert.Equal(t, KindClosed, ErrKind(io.EOF))
+	assert.Equal(t, KindClosed, ErrKind(fmt.Errorf("read: %w", net.ErrClosed)))
+	assert.Equal(t, KindClosed, ErrKind(toyqueue.ErrClosed))
+	assert.Equal(t, KindIO, ErrKind(ErrAddressUnknown))
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+	return sb.buf.Write(p)
+}
+
+// events returns the logged events having the message
+func (sb *syncBuffer) events(msg string) (events []map[string]any) {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+	for _, line := range bytes.Split(sb.buf.Bytes(), []byte("\n")) {
+		event := map[string]any{}
+		if json.Unmarshal(line, &event) == nil && event["msg"] == msg {
+			events = append(events, event)
+		}
+	}
+	return
+}
+
+func TestTCPDepot_Logger(t *testing.T) {
+	mem := MemNet{}
+	logs := syncBuffer{}
+	depot := TCPDepot{
+		Net:    &mem,
+		Logger: slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	peers := make(chan *testPeer, 1)
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		peer := newTestPeer(false)
+		peers <- peer
+		return peer
+	})
+	assert.Nil(t, depot.Listen("logged"))
+	defer depot.Close()
+
+	conn, err := mem.Dial("logged")
+	assert.Nil(t, err)
+	_, err = conn.Write(Record('A', []byte("fine")))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len((<-peers).Received(1)))
+	_, err = conn.Write([]byte("!garbage"))
+	assert.Nil(t, err)
+	var events []map[string]any
+	assert.Eventually(t, func() bool {
+		events = logs.events("read failed")
+		return len(events) == 1
+	}, time.Second, time.Millisecond)
+	event := events[0]
+	assert.Equal(t, "WARN", event["level"])
+	assert.Equal(t, KindParse, event["kind"])
+	assert.Equal(t, "in", event["dir"])
+	assert.Equal(t, conn.LocalAddr().String(), event["addr"])
+	assert.Equal(t, false, event["outbound"])
+	assert.Equal(t, float64(len(Record('A', []byte("fine")))), event["offset"])
+	assert.Equal(t, ErrBadRecord.Error(), event["err"])
+	_ = conn.Close()
+}
+
+func TestTCPDepot_LogHandshake(t *testing.T) {
+	mem := MemNet{}
+	logs := syncBuffer{}
+	depot := TCPDepot{
+		Net:    &mem,
+		Hello:  &Hello{Protocol: "logged", MaxVersion: 1},
+		Logger: slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newTestPeer(false)
+	})
+	assert.Nil(t, depot.Listen("logged"))
+	defer depot.Close()
+
+	// a peer that hangs up is no news, one that disagrees is
+	conn, err := mem.Dial("logged")
+	assert.Nil(t, err)
+	_ = conn.Close()
+	other := TCPDepot{Net: &mem, Hello: &Hello{Protocol: "other", MaxVersion: 1}}
+	other.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newTestPeer(false)
+	})
+	assert.ErrorIs(t, other.Connect("logged"), ErrProtocolMismatch)
+	var events []map[string]any
+	assert.Eventually(t, func() bool {
+		events = logs.events("handshake failed")
+		return len(events) == 2
+	}, time.Second, time.Millisecond)
+	levels := map[any]any{}
+	for _, event := range events {
+		levels[event["kind"]] = event["level"]
+	}
+	assert.Equal(t, map[any]any{KindClosed: "DEBUG", KindHandshake: "WARN"}, levels)
+}
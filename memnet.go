@@ -0,0 +1,194 @@
+package toytlv
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrAddressInUse = errors.New("address in use")
+var ErrRefused = errors.New("connection refused")
+
+// MemNet is an in-process Network: a registry of named listeners,
+// connections being net.Pipe pairs. Set TCPDepot.Net to use it.
+// Faults can be injected for deterministic tests: write latency,
+// partial writes, mid-stream disconnects. The fault settings are
+// read when a connection is made, so set them in advance.
+type MemNet struct {
+	// Latency delays every write
+	Latency time.Duration
+	// MaxWrite, if nonzero, cuts writes into chunks of at most
+	// that many bytes, so the reader gets partial records
+	MaxWrite int
+	// DropAfter, if nonzero, breaks a connection once it has
+	// written that many bytes
+	DropAfter int
+
+	mx        sync.Mutex
+	listeners map[string]*memListener
+	conns     map[*memConn]struct{}
+	seq       int
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	net    *MemNet
+	addr   memAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+type memConn struct {
+	net.Conn
+	net      *MemNet
+	local    memAddr
+	remote   memAddr
+	latency  time.Duration
+	maxWrite int
+	left     int // bytes till drop, if dropping
+	drop     bool
+}
+
+func (mn *MemNet) Listen(addr string) (net.Listener, error) {
+	mn.mx.Lock()
+	defer mn.mx.Unlock()
+	if mn.listeners == nil {
+		mn.listeners = make(map[string]*memListener)
+	}
+	if _, ok := mn.listeners[addr]; ok {
+		return nil, ErrAddressInUse
+	}
+	l := &memListener{
+		net:    mn,
+		addr:   memAddr(addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	mn.listeners[addr] = l
+	return l, nil
+}
+
+func (mn *MemNet) Dial(addr string) (net.Conn, error) {
+	mn.mx.Lock()
+	l, ok := mn.listeners[addr]
+	mn.seq++
+	client := memAddr("mem:" + strconv.Itoa(mn.seq))
+	mn.mx.Unlock()
+	if !ok {
+		return nil, ErrRefused
+	}
+	c, s := net.Pipe()
+	cc := mn.wrap(c, client, l.addr)
+	sc := mn.wrap(s, l.addr, client)
+	select {
+	case l.conns <- sc:
+		return cc, nil
+	case <-l.closed:
+		_ = cc.Close()
+		_ = sc.Close()
+		return nil, ErrRefused
+	}
+}
+
+func (mn *MemNet) wrap(conn net.Conn, local, remote memAddr) *memConn {
+	mc := &memConn{
+		Conn:     conn,
+		net:      mn,
+		local:    local,
+		remote:   remote,
+		latency:  mn.Latency,
+		maxWrite: mn.MaxWrite,
+		left:     mn.DropAfter,
+		drop:     mn.DropAfter > 0,
+	}
+	mn.mx.Lock()
+	if mn.conns == nil {
+		mn.conns = make(map[*memConn]struct{})
+	}
+	mn.conns[mc] = struct{}{}
+	mn.mx.Unlock()
+	return mc
+}
+
+// Break closes all the connections to or from the address,
+// as if the network failed.
+func (mn *MemNet) Break(addr string) (n int) {
+	mn.mx.Lock()
+	var broken []*memConn
+	for mc := range mn.conns {
+		if string(mc.local) == addr || string(mc.remote) == addr {
+			broken = append(broken, mc)
+		}
+	}
+	mn.mx.Unlock()
+	for _, mc := range broken {
+		_ = mc.Close()
+	}
+	return len(broken)
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.net.mx.Lock()
+		if l.net.listeners[string(l.addr)] == l {
+			delete(l.net.listeners, string(l.addr))
+		}
+		l.net.mx.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (mc *memConn) LocalAddr() net.Addr  { return mc.local }
+func (mc *memConn) RemoteAddr() net.Addr { return mc.remote }
+
+func (mc *memConn) Write(data []byte) (n int, err error) {
+	if mc.latency > 0 {
+		time.Sleep(mc.latency)
+	}
+	for n < len(data) && err == nil {
+		chunk := data[n:]
+		if mc.maxWrite > 0 && len(chunk) > mc.maxWrite {
+			chunk = chunk[:mc.maxWrite]
+		}
+		if mc.drop && len(chunk) >= mc.left {
+			chunk = chunk[:mc.left]
+			m, _ := mc.Conn.Write(chunk)
+			n += m
+			_ = mc.Close()
+			return n, net.ErrClosed
+		}
+		var m int
+		m, err = mc.Conn.Write(chunk)
+		n += m
+		mc.left -= m
+	}
+	return
+}
+
+func (mc *memConn) Close() error {
+	mc.net.mx.Lock()
+	delete(mc.net.conns, mc)
+	mc.net.mx.Unlock()
+	return mc.Conn.Close()
+}
@@ -0,0 +1,108 @@
+package toytlv
+
+import (
+	"expvar"
+	"github.com/learn-decentralized-systems/toyqueue"
+)
+
+// Direction of the traffic, as seen by Metrics
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "out"
+	}
+	return "in"
+}
+
+// Metrics gets the numbers of the traffic: TCPDepot connections,
+// feeders and drainers report to it, if set. The calls are on the hot
+// path, so implementations must be fast and safe for concurrent use.
+type Metrics interface {
+	// Records is a batch of records read or written
+	Records(dir Direction, recs toyqueue.Records)
+	// ParseError is a framing error, e.g. ErrBadRecord
+	ParseError(dir Direction, err error)
+	// Reconnect is an outbound connection re-established
+	Reconnect(addr string)
+	// QueueDepth is a change in the number of records queued by a
+	// connection, not written yet: coalesced or waiting in the Lanes.
+	// The changes add up to the depth of all the connections.
+	QueueDepth(dir Direction, delta int)
+}
+
+// sizeBuckets are the upper bounds of the record size histogram
+var sizeBuckets = [...]int{64, 1 << 10, 1 << 14, 1 << 18}
+var sizeNames = [...]string{"64", "1K", "16K", "256K", "big"}
+
+// ExpvarMetrics publishes the numbers with expvar, as a map of:
+//   - "in.A.records", "out.A.bytes": per direction, per record type,
+//   - "in.size.1K": the histogram of record sizes (up to 64, 1K, 16K,
+//     256K bytes, then "big"),
+//   - "in.parse_errors", "reconnects", "out.queue_depth" (of all the
+//     connections together).
+type ExpvarMetrics struct {
+	Map     *expvar.Map
+	records [2][256]string
+	bytes   [2][256]string
+	sizes   [2][len(sizeNames)]string
+	depth   [2]expvar.Int
+}
+
+// NewExpvarMetrics publishes the metrics under the name; like
+// expvar.NewMap, it panics if the name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	return newExpvarMetrics(expvar.NewMap(name))
+}
+
+func newExpvarMetrics(vars *expvar.Map) *ExpvarMetrics {
+	em := &ExpvarMetrics{Map: vars}
+	for dir := Inbound; dir <= Outbound; dir++ {
+		for lit := 0; lit < 256; lit++ {
+			l := string(rune(lit))
+			em.records[dir][lit] = dir.String() + "." + l + ".records"
+			em.bytes[dir][lit] = dir.String() + "." + l + ".bytes"
+		}
+		for i, size := range sizeNames {
+			em.sizes[dir][i] = dir.String() + ".size." + size
+		}
+		em.Map.Set(dir.String()+".queue_depth", &em.depth[dir])
+	}
+	return em
+}
+
+func (em *ExpvarMetrics) Records(dir Direction, recs toyqueue.Records) {
+	for _, rec := range recs {
+		if len(rec) == 0 {
+			continue
+		}
+		lit := Lit(rec)
+		em.Map.Add(em.records[dir][lit], 1)
+		em.Map.Add(em.bytes[dir][lit], int64(len(rec)))
+		bucket := len(sizeBuckets)
+		for i, max := range sizeBuckets {
+			if len(rec) <= max {
+				bucket = i
+				break
+			}
+		}
+		em.Map.Add(em.sizes[dir][bucket], 1)
+	}
+}
+
+func (em *ExpvarMetrics) ParseError(dir Direction, err error) {
+	em.Map.Add(dir.String()+".parse_errors", 1)
+}
+
+func (em *ExpvarMetrics) Reconnect(addr string) {
+	em.Map.Add("reconnects", 1)
+}
+
+func (em *ExpvarMetrics) QueueDepth(dir Direction, delta int) {
+	em.depth[dir].Add(int64(delta))
+}
@@ -0,0 +1,72 @@
+package toytlv
+
+import (
+	"bytes"
+	"expvar"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	em := newExpvarMetrics(new(expvar.Map))
+	var buf bytes.Buffer
+	writer := Writer2Drainer{Writer: &buf, Metrics: em}
+	big := Record('B', make([]byte, 2000))
+	assert.Nil(t, writer.Drain(toyqueue.Records{Record('A', []byte("a")), big}))
+	assert.Equal(t, "1", em.Map.Get("out.A.records").String())
+	assert.Equal(t, "2005", em.Map.Get("out.B.bytes").String())
+	assert.Equal(t, "1", em.Map.Get("out.size.64").String())
+	assert.Equal(t, "1", em.Map.Get("out.size.16K").String())
+
+	buf.WriteString("!bad")
+	reader := Reader2Feeder{Reader: &buf, Metrics: em}
+	recs, err := reader.Feed()
+	assert.Equal(t, ErrBadRecord, err)
+	assert.Equal(t, 2, len(recs))
+	assert.Equal(t, "1", em.Map.Get("in.B.records").String())
+	assert.Equal(t, "1", em.Map.Get("in.parse_errors").String())
+}
+
+func TestTCPDepot_Metrics(t *testing.T) {
+	em := newExpvarMetrics(new(expvar.Map))
+	mem := MemNet{}
+	server := TCPDepot{Net: &mem}
+	server.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newTestPeer(true)
+	})
+	assert.Nil(t, server.Listen("metered"))
+	assert.Nil(t, server.Listen("metered2"))
+	defer server.Close()
+	client, other := newTestPeer(false), newTestPeer(false)
+	depot := TCPDepot{Net: &mem, Metrics: em}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		if conn.RemoteAddr().String() == "metered2" {
+			return other
+		}
+		return client
+	})
+	defer depot.Close()
+	assert.Nil(t, depot.Connect("metered"))
+	assert.Nil(t, depot.Connect("metered2"))
+	depot.Conn("metered").Coalesce(1<<20, time.Millisecond*200)
+	depot.Conn("metered2").Coalesce(1<<20, time.Second*10)
+	client.Send(toyqueue.Records{Record('M', []byte("one")), Record('M', []byte("two"))})
+	other.Send(toyqueue.Records{Record('M', []byte("three"))})
+	// coalesced, so queued for a while; the depth is of both
+	assert.Eventually(t, func() bool {
+		return em.Map.Get("out.queue_depth").String() == "3"
+	}, time.Second, time.Millisecond)
+	client.Received(2)
+	assert.Eventually(t, func() bool {
+		return em.Map.Get("in.M.records").String() == "2" &&
+			em.Map.Get("out.M.records").String() == "3"
+	}, time.Second, time.Millisecond)
+	// a connection that is over queues nothing
+	depot.Conn("metered2").stop()
+	assert.Eventually(t, func() bool {
+		return em.Map.Get("out.queue_depth").String() == "2"
+	}, time.Second, time.Millisecond)
+}
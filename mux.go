@@ -0,0 +1,326 @@
+package toytlv
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"sync"
+)
+
+// MuxLit is the envelope of multiplexed records. The body is the
+// channel ID (uvarint) followed by the channel's records. Channel 0
+// is the control channel, its records are 'O' open (ID), 'C' close
+// (ID) and 'W' window credit (ID, bytes), all uvarints.
+const MuxLit = 'X'
+
+// DefaultMuxWindow is the default per-channel receive window, bytes
+const DefaultMuxWindow = 1 << 20
+
+var ErrChannelInUse = errors.New("mux: channel ID in use")
+var ErrWindowExceeded = errors.New("mux: the peer exceeded the window")
+
+// Mux multiplexes logical channels over one connection. It is the
+// inout of a connection (see Jack): Drain takes records off the wire,
+// Feed gives records to send. A Mux serves one connection; the peer
+// must run a Mux as well.
+//
+// Channels are opened by either side by ID; the subsystems agree on
+// IDs beforehand (e.g. 1 is replication, 2 is chat). Every channel
+// has independent flow control: the receiver grants credit as its
+// side consumes records, so a stalled channel never blocks others.
+type Mux struct {
+	// Window is the receive window of a channel, bytes
+	Window int
+	// OnOpen is called when the peer opens a channel. Must not block.
+	// If nil, such channels get closed.
+	OnOpen func(ch *MuxChannel)
+	// Default gets records that are not mux envelopes; if nil, those
+	// are an error
+	Default toyqueue.Drainer
+
+	mx     sync.Mutex
+	co     sync.Cond
+	chans  map[uint64]*MuxChannel
+	out    toyqueue.Records
+	closed bool
+}
+
+// MuxChannel is a logical channel. Drain sends records to the peer,
+// blocking while out of credit; Feed returns the peer's records.
+type MuxChannel struct {
+	ID  uint64
+	mux *Mux
+	in  toyqueue.Records
+	// bytes buffered, bytes consumed since the last grant
+	inlen, consumed int
+	// bytes we may send
+	credit     int
+	closed     bool
+	peerClosed bool
+}
+
+func (mux *Mux) init() {
+	if mux.chans == nil {
+		mux.co.L = &mux.mx
+		mux.chans = make(map[uint64]*MuxChannel)
+	}
+}
+
+func (mux *Mux) window() int {
+	if mux.Window <= 0 {
+		return DefaultMuxWindow
+	}
+	return mux.Window
+}
+
+// control queues a control record; the caller holds the lock
+func (mux *Mux) control(lit byte, id uint64, credit int) {
+	body := binary.AppendUvarint(nil, id)
+	if lit == 'W' {
+		body = binary.AppendUvarint(body, uint64(credit))
+	}
+	mux.send(0, toyqueue.Records{Record(lit, body)})
+}
+
+// send queues an envelope; the caller holds the lock
+func (mux *Mux) send(id uint64, recs toyqueue.Records) {
+	bodylen := TotalLen(recs) + binary.MaxVarintLen64
+	bm, env := OpenHeader(make([]byte, 0, bodylen+5), MuxLit)
+	env = binary.AppendUvarint(env, id)
+	for _, rec := range recs {
+		env = append(env, rec...)
+	}
+	CloseHeader(env, bm)
+	mux.out = append(mux.out, env)
+	mux.co.Broadcast()
+}
+
+func (mux *Mux) newChannel(id uint64) *MuxChannel {
+	ch := &MuxChannel{ID: id, mux: mux}
+	mux.chans[id] = ch
+	mux.control('W', id, mux.window())
+	return ch
+}
+
+// Open opens a channel. The peer gets it in OnOpen, unless it
+// opens the same ID itself.
+func (mux *Mux) Open(id uint64) (*MuxChannel, error) {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	mux.init()
+	if mux.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	if _, ok := mux.chans[id]; ok || id == 0 {
+		return nil, ErrChannelInUse
+	}
+	mux.control('O', id, 0)
+	return mux.newChannel(id), nil
+}
+
+// Channel returns an open channel by ID, if any.
+func (mux *Mux) Channel(id uint64) *MuxChannel {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	return mux.chans[id]
+}
+
+// Feed returns the records to send to the peer.
+func (mux *Mux) Feed() (recs toyqueue.Records, err error) {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	mux.init()
+	for len(mux.out) == 0 && !mux.closed {
+		mux.co.Wait()
+	}
+	if mux.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	recs, mux.out = mux.out, nil
+	return
+}
+
+// Drain takes the records from the peer.
+func (mux *Mux) Drain(recs toyqueue.Records) (err error) {
+	var opened []*MuxChannel
+	var other toyqueue.Records
+	mux.mx.Lock()
+	mux.init()
+	for _, rec := range recs {
+		if len(rec) == 0 || Lit(rec) != MuxLit {
+			other = append(other, rec)
+			continue
+		}
+		var body []byte
+		body, _, err = TakeWary(MuxLit, rec)
+		if err != nil {
+			break
+		}
+		id, n := binary.Uvarint(body)
+		if n <= 0 {
+			err = ErrBadRecord
+			break
+		}
+		var inner toyqueue.Records
+		inner, _, err = Split(body[n:])
+		if err == nil && TotalLen(inner) != len(body)-n {
+			err = ErrBadRecord
+		}
+		if err != nil {
+			break
+		}
+		if id == 0 {
+			opened, err = mux.doControl(inner, opened)
+		} else {
+			err = mux.deliver(id, inner)
+		}
+		if err != nil {
+			break
+		}
+	}
+	mux.mx.Unlock()
+	for _, ch := range opened {
+		mux.OnOpen(ch)
+	}
+	if err == nil && len(other) > 0 {
+		if mux.Default == nil {
+			return ErrBadRecord
+		}
+		err = mux.Default.Drain(other)
+	}
+	return
+}
+
+// doControl processes control records; the caller holds the lock
+func (mux *Mux) doControl(recs toyqueue.Records, opened []*MuxChannel) ([]*MuxChannel, error) {
+	for _, rec := range recs {
+		lit, body, _ := TakeAny(rec)
+		id, n := binary.Uvarint(body)
+		if n <= 0 || id == 0 {
+			return opened, ErrBadRecord
+		}
+		ch := mux.chans[id]
+		switch lit {
+		case 'O':
+			if ch != nil {
+				break // opened by both sides
+			}
+			if mux.OnOpen == nil {
+				mux.control('C', id, 0)
+				break
+			}
+			opened = append(opened, mux.newChannel(id))
+		case 'C':
+			if ch != nil {
+				ch.peerClosed = true
+				delete(mux.chans, id)
+				mux.co.Broadcast()
+			}
+		case 'W':
+			credit, m := binary.Uvarint(body[n:])
+			if m <= 0 {
+				return opened, ErrBadRecord
+			}
+			if ch != nil {
+				ch.credit += int(credit)
+				mux.co.Broadcast()
+			}
+		}
+	}
+	return opened, nil
+}
+
+// deliver buffers a channel's records; the caller holds the lock
+func (mux *Mux) deliver(id uint64, recs toyqueue.Records) error {
+	ch := mux.chans[id]
+	if ch == nil {
+		return nil // closed by us, in flight
+	}
+	if ch.inlen >= mux.window() {
+		return ErrWindowExceeded
+	}
+	ch.in = append(ch.in, recs...)
+	ch.inlen += TotalLen(recs)
+	mux.co.Broadcast()
+	return nil
+}
+
+// Close closes the mux and all of its channels.
+func (mux *Mux) Close() error {
+	mux.mx.Lock()
+	mux.init()
+	mux.closed = true
+	for id, ch := range mux.chans {
+		ch.closed = true
+		delete(mux.chans, id)
+	}
+	mux.co.Broadcast()
+	mux.mx.Unlock()
+	return nil
+}
+
+// Drain sends the records to the peer, waiting for credit as needed.
+func (ch *MuxChannel) Drain(recs toyqueue.Records) error {
+	mux := ch.mux
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	for len(recs) > 0 {
+		for ch.credit <= 0 && !ch.closed && !ch.peerClosed {
+			mux.co.Wait()
+		}
+		if ch.closed || ch.peerClosed {
+			return toyqueue.ErrClosed
+		}
+		n, size := 1, len(recs[0])
+		for n < len(recs) && size+len(recs[n]) <= ch.credit {
+			size += len(recs[n])
+			n++
+		}
+		ch.credit -= size
+		mux.send(ch.ID, recs[:n])
+		recs = recs[n:]
+	}
+	return nil
+}
+
+// Feed returns the peer's records, waiting for some as needed.
+// Once the peer closes the channel, ErrClosed follows the data.
+func (ch *MuxChannel) Feed() (recs toyqueue.Records, err error) {
+	mux := ch.mux
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	for len(ch.in) == 0 && !ch.closed && !ch.peerClosed {
+		mux.co.Wait()
+	}
+	if ch.closed || len(ch.in) == 0 {
+		return nil, toyqueue.ErrClosed
+	}
+	recs, ch.in = ch.in, nil
+	size := TotalLen(recs)
+	ch.inlen -= size
+	ch.consumed += size
+	if !ch.peerClosed && ch.consumed >= mux.window()/2 {
+		mux.control('W', ch.ID, ch.consumed)
+		ch.consumed = 0
+	}
+	return
+}
+
+// Close closes the channel; the underlying connection stays.
+func (ch *MuxChannel) Close() error {
+	mux := ch.mux
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	if ch.closed {
+		return nil
+	}
+	ch.closed = true
+	if mux.chans[ch.ID] == ch {
+		delete(mux.chans, ch.ID)
+		if !mux.closed {
+			mux.control('C', ch.ID, 0)
+		}
+	}
+	mux.co.Broadcast()
+	return nil
+}
@@ -0,0 +1,131 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxPair connects two muxes back to back
+func muxPair(a, b *Mux) {
+	pump := func(from, to *Mux) {
+		for {
+			recs, err := from.Feed()
+			if err != nil || to.Drain(recs) != nil {
+				return
+			}
+		}
+	}
+	go pump(a, b)
+	go pump(b, a)
+}
+
+func TestMux_Channels(t *testing.T) {
+	opened := make(chan *MuxChannel, 4)
+	a := Mux{Window: 256}
+	b := Mux{Window: 256, OnOpen: func(ch *MuxChannel) { opened <- ch }}
+	muxPair(&a, &b)
+	defer a.Close()
+	defer b.Close()
+
+	bulk, err := a.Open(1)
+	assert.Nil(t, err)
+	_, err = a.Open(1)
+	assert.Equal(t, ErrChannelInUse, err)
+	chat, err := a.Open(2)
+	assert.Nil(t, err)
+	bbulk, bchat := <-opened, <-opened
+	assert.Equal(t, uint64(1), bbulk.ID)
+	assert.Equal(t, uint64(2), bchat.ID)
+
+	// nobody reads bulk: it stalls once the window is full
+	rec := Record('B', make([]byte, 100))
+	stalled := make(chan error)
+	go func() {
+		stalled <- bulk.Drain(toyqueue.Records{rec, rec, rec, rec, rec})
+	}()
+	// the chat goes on
+	hi := toyqueue.Records{Record('M', []byte("hi"))}
+	assert.Nil(t, chat.Drain(hi))
+	recs, err := bchat.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, hi, recs)
+	select {
+	case <-stalled:
+		t.Fatal("the window is not enforced")
+	case <-time.After(time.Millisecond * 10):
+	}
+	// reading bulk grants credit
+	var got toyqueue.Records
+	for len(got) < 5 {
+		recs, err = bbulk.Feed()
+		assert.Nil(t, err)
+		got = append(got, recs...)
+	}
+	assert.Nil(t, <-stalled)
+	assert.Equal(t, rec, got[4])
+
+	// closing a channel keeps the rest
+	assert.Nil(t, chat.Close())
+	_, err = bchat.Feed()
+	assert.Equal(t, toyqueue.ErrClosed, err)
+	assert.Equal(t, toyqueue.ErrClosed, bchat.Drain(hi))
+	assert.Nil(t, bbulk.Drain(hi))
+	recs, err = bulk.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, hi, recs)
+
+	// a has no OnOpen, so the channel gets closed
+	nope, err := b.Open(3)
+	assert.Nil(t, err)
+	_, err = nope.Feed()
+	assert.Equal(t, toyqueue.ErrClosed, err)
+}
+
+func TestMux_Window(t *testing.T) {
+	mux := Mux{Window: 16}
+	_, _ = mux.Open(1)
+	data := Record(MuxLit, append([]byte{1}, Record('D', make([]byte, 20))...))
+	assert.Nil(t, mux.Drain(toyqueue.Records{data}))
+	assert.Equal(t, ErrWindowExceeded, mux.Drain(toyqueue.Records{data}))
+	assert.Equal(t, ErrBadRecord, mux.Drain(toyqueue.Records{Record('A', nil)}))
+	def := testQueue{}
+	mux.Default = &def
+	assert.Nil(t, mux.Drain(toyqueue.Records{Record('A', nil)}))
+	assert.Equal(t, 1, len(def.recs))
+}
+
+func TestMux_TCPDepot(t *testing.T) {
+	mem := MemNet{}
+	chans := make(chan *MuxChannel, 1)
+	depot := TCPDepot{Net: &mem}
+	muxes := make(chan *Mux, 2)
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		mux := &Mux{OnOpen: func(ch *MuxChannel) { chans <- ch }}
+		muxes <- mux
+		return mux
+	})
+	assert.Nil(t, depot.Listen("mux"))
+	defer depot.Close()
+	assert.Nil(t, depot.Connect("mux"))
+	client := <-muxes
+	ch, err := client.Open(7)
+	assert.Nil(t, err)
+	echo := <-chans
+	go func() {
+		for {
+			recs, err := echo.Feed()
+			if err != nil || echo.Drain(recs) != nil {
+				return
+			}
+		}
+	}()
+	ping := toyqueue.Records{Record('P', []byte("ping"))}
+	assert.Nil(t, ch.Drain(ping))
+	recs, err := ch.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, ping, recs)
+	assert.Nil(t, ch.Close())
+}
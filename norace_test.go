@@ -0,0 +1,5 @@
+//go:build !race
+
+package toytlv
+
+const raceEnabled = false
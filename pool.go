@@ -0,0 +1,78 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"math/bits"
+	"sync"
+)
+
+const minPoolShift = 6  // 64 bytes
+const maxPoolShift = 20 // 1MB
+const poolClasses = maxPoolShift - minPoolShift + 1
+
+// BufPool is a size-classed pool of byte buffers, the classes being
+// powers of two from 64 bytes to 1MB. Readers and TCPDepot use a pool
+// if one is set: every record they return then gets its own pooled
+// buffer, to be returned with Release() once consumed.
+type BufPool struct {
+	classes [poolClasses]sync.Pool
+	holders sync.Pool // spare *[]byte to avoid allocs on Put
+}
+
+// DefaultPool is there for those who don't need a separate one.
+var DefaultPool = &BufPool{}
+
+// Get returns an empty buffer of capacity no less than size.
+func (p *BufPool) Get(size int) []byte {
+	c := 0
+	if size > 1<<minPoolShift {
+		c = bits.Len(uint(size-1)) - minPoolShift
+	}
+	if c >= poolClasses {
+		return make([]byte, 0, size)
+	}
+	h, ok := p.classes[c].Get().(*[]byte)
+	if !ok {
+		return make([]byte, 0, 1<<(c+minPoolShift))
+	}
+	buf := *h
+	*h = nil
+	p.holders.Put(h)
+	return buf[:0]
+}
+
+// Put returns a buffer to the pool; the buffer must not be used after.
+// Buffers larger than the largest class are left to the GC, as are
+// the ones smaller than the smallest.
+func (p *BufPool) Put(buf []byte) {
+	c := bits.Len(uint(cap(buf))) - 1 - minPoolShift
+	if c < 0 || cap(buf) > 1<<maxPoolShift {
+		return
+	}
+	h, ok := p.holders.Get().(*[]byte)
+	if !ok {
+		h = new([]byte)
+	}
+	*h = buf[:0]
+	p.classes[c].Put(h)
+}
+
+// Release returns the buffers of consumed records to the pool.
+func (p *BufPool) Release(recs toyqueue.Records) {
+	for _, rec := range recs {
+		p.Put(rec)
+	}
+}
+
+// Record composes a record of a given type in a pooled buffer
+func (p *BufPool) Record(lit byte, body ...[]byte) []byte {
+	total := TotalLen(body)
+	return Append(p.Get(total+5), lit, body...)
+}
+
+// detach copies records into pooled buffers of their own
+func (p *BufPool) detach(recs toyqueue.Records) {
+	for i, rec := range recs {
+		recs[i] = append(p.Get(len(rec)), rec...)
+	}
+}
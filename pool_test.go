@@ -0,0 +1,120 @@
+package toytlv
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestBufPool_Get(t *testing.T) {
+	pool := BufPool{}
+	assert.Equal(t, 64, cap(pool.Get(1)))
+	assert.Equal(t, 64, cap(pool.Get(64)))
+	assert.Equal(t, 128, cap(pool.Get(65)))
+	assert.Equal(t, 2<<20, cap(pool.Get(2<<20)))
+	buf := pool.Get(100)
+	buf = append(buf, "test"...)
+	pool.Put(buf)
+	pool.Put(make([]byte, 10)) // too small, dropped
+	again := pool.Get(100)
+	assert.Equal(t, 0, len(again))
+	assert.Equal(t, 128, cap(again))
+
+	pool.Put(make([]byte, 0, 4<<20)) // too big, dropped
+	assert.Equal(t, 1<<20, cap(pool.Get(1<<20)))
+}
+
+func TestBufPool_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool is randomized under -race")
+	}
+	pool := BufPool{}
+	pool.Put(pool.Get(1000))
+	allocs := testing.AllocsPerRun(1000, func() {
+		pool.Put(pool.Get(1000))
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func poolTestStream(n int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		data = Append(data, 'A', bytes.Repeat([]byte{byte(i)}, i%300))
+	}
+	return data
+}
+
+func TestReader2Feeder_Pool(t *testing.T) {
+	const N = 1000
+	data := poolTestStream(N)
+	pool := BufPool{}
+	reader := Reader2Feeder{Reader: bytes.NewReader(data), Pool: &pool}
+	i := 0
+	for {
+		recs, err := reader.Feed()
+		for _, rec := range recs {
+			body, rest, err := TakeWary('A', rec)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(rest))
+			assert.Equal(t, bytes.Repeat([]byte{byte(i)}, i%300), body)
+			i++
+		}
+		pool.Release(recs)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, N, i)
+}
+
+func feedAllocs(data []byte, pool *BufPool) float64 {
+	rdr := bytes.NewReader(data)
+	reader := Reader2Feeder{Reader: rdr, Pool: pool}
+	return testing.AllocsPerRun(100, func() {
+		rdr.Reset(data)
+		for {
+			recs, err := reader.Feed()
+			if pool != nil {
+				pool.Release(recs)
+			}
+			if err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestReader2Feeder_PoolAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool is randomized under -race")
+	}
+	data := poolTestStream(1000)
+	plain := feedAllocs(data, nil)
+	pooled := feedAllocs(data, &BufPool{})
+	assert.Less(t, pooled, plain)
+}
+
+func benchmarkFeed(b *testing.B, pool *BufPool) {
+	data := poolTestStream(1000)
+	rdr := bytes.NewReader(data)
+	reader := Reader2Feeder{Reader: rdr, Pool: pool}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rdr.Reset(data)
+		for {
+			recs, err := reader.Feed()
+			if pool != nil {
+				pool.Release(recs)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkReader2Feeder(b *testing.B)     { benchmarkFeed(b, nil) }
+func BenchmarkReader2FeederPool(b *testing.B) { benchmarkFeed(b, &BufPool{}) }
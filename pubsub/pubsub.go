@@ -0,0 +1,224 @@
+// Package pubsub is topic-based publish/subscribe over toytlv
+// connections. Peers tell each other what they are interested in
+// with 'S' subscribe and 'U' unsubscribe records (the body is the
+// topic), publishers send 'P' records only to the interested peers.
+// A 'P' body is a 'T' topic record followed by the published records.
+package pubsub
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"net"
+	"sync"
+)
+
+const (
+	SubscribeLit   = 'S'
+	UnsubscribeLit = 'U'
+	PublishLit     = 'P'
+	TopicLit       = 'T'
+)
+
+// Hub keeps the local subscriptions and the subscriptions of the
+// peers, one table per connection. Use Hub.Jack for a TCPDepot.
+// The subscriptions get restated when a connection is re-established,
+// see toytlv.Reconnecter.
+type Hub struct {
+	mx       sync.Mutex
+	topics   map[string]toyqueue.Drainer
+	sessions map[*session]struct{}
+}
+
+// session is the inout of one connection
+type session struct {
+	hub    *Hub
+	mx     sync.Mutex
+	co     sync.Cond
+	out    toyqueue.Records
+	subs   map[string]bool
+	closed bool
+}
+
+func (hub *Hub) init() {
+	if hub.topics == nil {
+		hub.topics = make(map[string]toyqueue.Drainer)
+		hub.sessions = make(map[*session]struct{})
+	}
+}
+
+// Jack is a toytlv.Jack making a session per connection.
+func (hub *Hub) Jack(conn net.Conn) toyqueue.FeedDrainCloser {
+	s := &session{hub: hub, subs: make(map[string]bool)}
+	s.co.L = &s.mx
+	hub.mx.Lock()
+	hub.init()
+	hub.sessions[s] = struct{}{}
+	subs := hub.subscriptions()
+	hub.mx.Unlock()
+	s.send(subs...)
+	return s
+}
+
+// subscriptions makes 'S' records for all the local topics;
+// the caller holds the lock
+func (hub *Hub) subscriptions() (recs toyqueue.Records) {
+	for topic := range hub.topics {
+		recs = append(recs, toytlv.Record(SubscribeLit, []byte(topic)))
+	}
+	return
+}
+
+// each sends records to every session; the caller holds the lock
+func (hub *Hub) each(recs ...[]byte) {
+	for s := range hub.sessions {
+		s.send(recs...)
+	}
+}
+
+// Subscribe makes the records published to the topic go to the sink.
+// A topic has one sink; subscribing again replaces it.
+func (hub *Hub) Subscribe(topic string, sink toyqueue.Drainer) {
+	hub.mx.Lock()
+	defer hub.mx.Unlock()
+	hub.init()
+	_, had := hub.topics[topic]
+	hub.topics[topic] = sink
+	if !had {
+		hub.each(toytlv.Record(SubscribeLit, []byte(topic)))
+	}
+}
+
+// Unsubscribe cancels the subscription to the topic.
+func (hub *Hub) Unsubscribe(topic string) {
+	hub.mx.Lock()
+	defer hub.mx.Unlock()
+	hub.init()
+	if _, had := hub.topics[topic]; had {
+		delete(hub.topics, topic)
+		hub.each(toytlv.Record(UnsubscribeLit, []byte(topic)))
+	}
+}
+
+// Publish sends the records to the peers subscribed to the topic.
+// Returns the number of such peers.
+func (hub *Hub) Publish(topic string, recs toyqueue.Records) (n int) {
+	bm, rec := toytlv.OpenHeader(nil, PublishLit)
+	rec = toytlv.Append(rec, TopicLit, []byte(topic))
+	for _, r := range recs {
+		rec = append(rec, r...)
+	}
+	toytlv.CloseHeader(rec, bm)
+	hub.mx.Lock()
+	defer hub.mx.Unlock()
+	for s := range hub.sessions {
+		if s.subscribed(topic) {
+			s.send(rec)
+			n++
+		}
+	}
+	return
+}
+
+func (hub *Hub) sink(topic string) toyqueue.Drainer {
+	hub.mx.Lock()
+	defer hub.mx.Unlock()
+	return hub.topics[topic]
+}
+
+func (s *session) subscribed(topic string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.subs[topic]
+}
+
+func (s *session) send(recs ...[]byte) {
+	if len(recs) == 0 {
+		return
+	}
+	s.mx.Lock()
+	if !s.closed {
+		s.out = append(s.out, recs...)
+		s.co.Broadcast()
+	}
+	s.mx.Unlock()
+}
+
+func (s *session) Feed() (recs toyqueue.Records, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for len(s.out) == 0 && !s.closed {
+		s.co.Wait()
+	}
+	if s.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	recs, s.out = s.out, nil
+	return
+}
+
+func (s *session) Drain(recs toyqueue.Records) error {
+	for _, rec := range recs {
+		lit, body, rest, err := toytlv.TakeAnyWary(rec)
+		if err != nil || len(rest) != 0 {
+			return toytlv.ErrBadRecord
+		}
+		switch lit {
+		case SubscribeLit:
+			s.mx.Lock()
+			s.subs[string(body)] = true
+			s.mx.Unlock()
+		case UnsubscribeLit:
+			s.mx.Lock()
+			delete(s.subs, string(body))
+			s.mx.Unlock()
+		case PublishLit:
+			topic, rest, err := toytlv.TakeWary(TopicLit, body)
+			if err != nil {
+				return toytlv.ErrBadRecord
+			}
+			published, tail, err := toytlv.Split(rest)
+			if err != nil || len(tail) != 0 {
+				return toytlv.ErrBadRecord
+			}
+			sink := s.hub.sink(string(topic))
+			if sink == nil {
+				continue // unsubscribed meanwhile
+			}
+			if err = sink.Drain(published); err != nil {
+				return err
+			}
+		default:
+			return toytlv.ErrBadRecord
+		}
+	}
+	return nil
+}
+
+// Reconnected forgets the subscriptions of the old peer and restates
+// ours to the new one.
+func (s *session) Reconnected(conn net.Conn) {
+	s.hub.mx.Lock()
+	subs := s.hub.subscriptions()
+	s.hub.mx.Unlock()
+	s.mx.Lock()
+	s.subs = make(map[string]bool)
+	s.out = append(subs, s.out...)
+	s.co.Broadcast()
+	s.mx.Unlock()
+}
+
+// Disconnected closes the session, the connection is over.
+func (s *session) Disconnected() {
+	_ = s.Close()
+}
+
+func (s *session) Close() error {
+	s.mx.Lock()
+	s.closed = true
+	s.co.Broadcast()
+	s.mx.Unlock()
+	s.hub.mx.Lock()
+	delete(s.hub.sessions, s)
+	s.hub.mx.Unlock()
+	return nil
+}
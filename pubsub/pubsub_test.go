@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sink struct {
+	mx   sync.Mutex
+	recs toyqueue.Records
+}
+
+func (s *sink) Drain(recs toyqueue.Records) error {
+	s.mx.Lock()
+	s.recs = append(s.recs, recs...)
+	s.mx.Unlock()
+	return nil
+}
+
+func (s *sink) len() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.recs)
+}
+
+// reconnects counts the reconnects of a depot
+type reconnects struct {
+	mx sync.Mutex
+	n  int
+}
+
+func (r *reconnects) Records(dir toytlv.Direction, recs toyqueue.Records) {}
+func (r *reconnects) ParseError(dir toytlv.Direction, err error)          {}
+func (r *reconnects) QueueDepth(dir toytlv.Direction, delta int)          {}
+
+func (r *reconnects) Reconnect(addr string) {
+	r.mx.Lock()
+	r.n++
+	r.mx.Unlock()
+}
+
+func (r *reconnects) count() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.n
+}
+
+func TestHub_Publish(t *testing.T) {
+	mem := toytlv.MemNet{}
+	pub := Hub{}
+	pdepot := toytlv.TCPDepot{Net: &mem}
+	pdepot.Open(pub.Jack)
+	assert.Nil(t, pdepot.Listen("pub"))
+	defer pdepot.Close()
+
+	sub := Hub{}
+	news, other := sink{}, sink{}
+	sub.Subscribe("news", &news)
+	recon := reconnects{}
+	sdepot := toytlv.TCPDepot{Net: &mem, Metrics: &recon, Reconnect: true}
+	sdepot.Open(sub.Jack)
+	defer sdepot.Close()
+	assert.Nil(t, sdepot.Connect("pub"))
+
+	published := func(topic string, n int) func() bool {
+		return func() bool {
+			return pub.Publish(topic, toyqueue.Records{toytlv.Record('M', []byte(topic))}) == n
+		}
+	}
+	assert.Eventually(t, published("news", 1), time.Second, time.Millisecond)
+	assert.Equal(t, 0, pub.Publish("other", toyqueue.Records{toytlv.Record('M')}))
+	assert.Eventually(t, func() bool { return news.len() > 0 }, time.Second, time.Millisecond)
+	news.mx.Lock()
+	assert.Equal(t, toytlv.Record('M', []byte("news")), news.recs[0])
+	news.mx.Unlock()
+
+	sub.Subscribe("other", &other)
+	assert.Eventually(t, published("other", 1), time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return other.len() > 0 }, time.Second, time.Millisecond)
+	sub.Unsubscribe("news")
+	assert.Eventually(t, published("news", 0), time.Second, time.Millisecond)
+
+	// the subscriptions survive a reconnect
+	assert.Equal(t, 2, mem.Break("pub"))
+	assert.Eventually(t, published("other", 0), time.Second, time.Millisecond)
+	was := other.len()
+	assert.Eventually(t, published("other", 1), time.Second*5, time.Millisecond*10)
+	assert.Eventually(t, func() bool { return other.len() > was }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, pub.Publish("news", nil))
+
+	// the subscriber talks over the new connection, which stays up
+	late := sink{}
+	sub.Subscribe("late", &late)
+	assert.Eventually(t, published("late", 1), time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return late.len() > 0 }, time.Second, time.Millisecond)
+	was = other.len()
+	assert.Equal(t, 1, pub.Publish("other", toyqueue.Records{toytlv.Record('M')}))
+	assert.Eventually(t, func() bool { return other.len() > was }, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 1, recon.count())
+}
@@ -0,0 +1,162 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"sync"
+	"time"
+)
+
+// maxThrottleSleep is how often a throttled Wait rechecks the rates
+const maxThrottleSleep = time.Millisecond * 100
+
+// RateLimit is a token bucket limiting bytes and records per second.
+// The bucket holds up to a second worth of tokens, so bursts are
+// allowed; a batch bigger than that goes into debt, the next batch
+// waits. Zero rates are no limit. One RateLimit may be shared by
+// many connections, e.g. for a depot-wide limit: callers reserve
+// their tokens in turn, each waits for the debt of those before.
+type RateLimit struct {
+	BytesPerSec   int
+	RecordsPerSec int
+
+	mx      sync.Mutex
+	bytes   float64
+	recs    float64
+	paid    [2]float64 // all the tokens ever refilled, bytes and records
+	last    time.Time
+	stats   RateStats
+	waited  time.Time // Throttled counts up to this moment
+	started bool
+	// the clock, time.Now and time.Sleep if nil
+	now   func() time.Time
+	sleep func(d time.Duration)
+}
+
+// RateStats is what passed a RateLimit and how long it waited.
+type RateStats struct {
+	Bytes   int64
+	Records int64
+	// Throttled is the time anyone waited; concurrent waits, e.g. of
+	// both directions sharing the limit, are counted once
+	Throttled time.Duration
+}
+
+// SetRate adjusts the rates on the fly; zeros are no limit.
+func (rl *RateLimit) SetRate(bytesPerSec, recordsPerSec int) {
+	rl.mx.Lock()
+	rl.refill(rl.clock())
+	rl.BytesPerSec = bytesPerSec
+	rl.RecordsPerSec = recordsPerSec
+	rl.mx.Unlock()
+}
+
+// Stats returns the stats.
+func (rl *RateLimit) Stats() RateStats {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	return rl.stats
+}
+
+func (rl *RateLimit) clock() time.Time {
+	if rl.now != nil {
+		return rl.now()
+	}
+	return time.Now()
+}
+
+func (rl *RateLimit) nap(d time.Duration) {
+	if rl.sleep != nil {
+		rl.sleep(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// refill adds the tokens accrued since the last time; the caller
+// holds the lock
+func (rl *RateLimit) refill(now time.Time) {
+	if !rl.started {
+		rl.started = true
+		rl.bytes = float64(rl.BytesPerSec)
+		rl.recs = float64(rl.RecordsPerSec)
+		rl.last = now
+		return
+	}
+	secs := now.Sub(rl.last).Seconds()
+	rl.last = now
+	rl.paid[0] += secs * float64(rl.BytesPerSec)
+	rl.paid[1] += secs * float64(rl.RecordsPerSec)
+	rl.bytes = bucket(rl.bytes, secs, rl.BytesPerSec)
+	rl.recs = bucket(rl.recs, secs, rl.RecordsPerSec)
+}
+
+func bucket(tokens, secs float64, rate int) float64 {
+	if rate <= 0 {
+		return 0
+	}
+	tokens += secs * float64(rate)
+	if tokens > float64(rate) {
+		tokens = float64(rate)
+	}
+	return tokens
+}
+
+// debt is how long till the tokens are out of debt
+func debt(tokens float64, rate int) time.Duration {
+	if rate <= 0 || tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / float64(rate) * float64(time.Second))
+}
+
+// Wait takes the tokens for the records, then waits for the debt
+// of the previous ones to be paid off. The tokens are taken at once,
+// so concurrent callers queue up; the rates may change meanwhile.
+func (rl *RateLimit) Wait(recs toyqueue.Records) {
+	if rl == nil {
+		return
+	}
+	size := TotalLen(recs)
+	rl.mx.Lock()
+	start := rl.clock()
+	rl.refill(start)
+	// the tokens before ours, less those paid so far: the debt
+	// ahead of us is paid off once ahead+paid is not negative
+	ahead := [2]float64{rl.bytes - rl.paid[0], rl.recs - rl.paid[1]}
+	if rl.BytesPerSec > 0 {
+		rl.bytes -= float64(size)
+	}
+	if rl.RecordsPerSec > 0 {
+		rl.recs -= float64(len(recs))
+	}
+	rl.stats.Bytes += int64(size)
+	rl.stats.Records += int64(len(recs))
+	now := start
+	for {
+		wait := debt(ahead[0]+rl.paid[0], rl.BytesPerSec)
+		if w := debt(ahead[1]+rl.paid[1], rl.RecordsPerSec); w > wait {
+			wait = w
+		}
+		if wait <= 0 {
+			break
+		}
+		if wait > maxThrottleSleep {
+			wait = maxThrottleSleep
+		}
+		rl.mx.Unlock()
+		rl.nap(wait)
+		rl.mx.Lock()
+		now = rl.clock()
+		rl.refill(now)
+	}
+	// the waits end in the order of the reservations, so the part
+	// before the end of the previous one is counted already
+	if start.Before(rl.waited) {
+		start = rl.waited
+	}
+	if now.After(start) {
+		rl.stats.Throttled += now.Sub(start)
+		rl.waited = now
+	}
+	rl.mx.Unlock()
+}
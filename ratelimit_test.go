@@ -0,0 +1,155 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a RateLimit clock; sleeping moves it forward
+type fakeClock struct {
+	mx    sync.Mutex
+	t     time.Time
+	slept time.Duration
+}
+
+func (fc *fakeClock) now() time.Time {
+	fc.mx.Lock()
+	defer fc.mx.Unlock()
+	return fc.t
+}
+
+func (fc *fakeClock) sleep(d time.Duration) {
+	fc.advance(d)
+}
+
+func (fc *fakeClock) advance(d time.Duration) {
+	fc.mx.Lock()
+	fc.t = fc.t.Add(d)
+	fc.slept += d
+	fc.mx.Unlock()
+}
+
+func (fc *fakeClock) limit(bytesPerSec, recordsPerSec int) *RateLimit {
+	return &RateLimit{
+		BytesPerSec:   bytesPerSec,
+		RecordsPerSec: recordsPerSec,
+		now:           fc.now,
+		sleep:         fc.sleep,
+	}
+}
+
+func TestRateLimit_Wait(t *testing.T) {
+	clock := fakeClock{}
+	rl := clock.limit(100000, 0)
+	kb := toyqueue.Records{make([]byte, 1000)}
+	for i := 0; i < 120; i++ { // a burst of 100, then 20 more
+		rl.Wait(kb)
+	}
+	// the 101st goes into debt, the 120th waits for 19 before it
+	assert.InDelta(t, time.Millisecond*190, clock.slept, float64(time.Microsecond))
+	stats := rl.Stats()
+	assert.Equal(t, int64(120000), stats.Bytes)
+	assert.Equal(t, int64(120), stats.Records)
+	assert.Equal(t, clock.slept, stats.Throttled)
+
+	// the records limit; no limit is no wait
+	rl.SetRate(0, 1000)
+	clock.advance(time.Second)
+	clock.slept = 0
+	for i := 0; i < 120; i++ {
+		rl.Wait(toyqueue.Records{nil, nil, nil, nil, nil, nil, nil, nil, nil, nil})
+	}
+	assert.InDelta(t, time.Millisecond*190, clock.slept, float64(time.Microsecond))
+	rl.SetRate(0, 0)
+	clock.slept = 0
+	rl.Wait(kb)
+	rl.Wait(kb)
+	assert.Equal(t, time.Duration(0), clock.slept)
+	var none *RateLimit
+	none.Wait(kb)
+}
+
+func TestRateLimit_Shared(t *testing.T) {
+	// the clock stands still till told, the waiters spin
+	clock := fakeClock{}
+	rl := clock.limit(10000, 0)
+	rl.sleep = func(time.Duration) { time.Sleep(time.Millisecond) }
+	kb := toyqueue.Records{make([]byte, 1000)}
+	var passed atomic.Int32
+	for i := 0; i < 25; i++ {
+		go func() {
+			rl.Wait(kb)
+			passed.Add(1)
+		}()
+	}
+	// a burst of 10, one more into debt, the rest queue up
+	assert.Eventually(t, func() bool {
+		return passed.Load() == 11
+	}, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, int32(11), passed.Load())
+	clock.advance(time.Second)
+	assert.Eventually(t, func() bool {
+		return passed.Load() == 21
+	}, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, int32(21), passed.Load())
+	// raising the rate lets the rest through sooner
+	rl.SetRate(40000, 0)
+	clock.advance(time.Millisecond * 100)
+	assert.Eventually(t, func() bool {
+		return passed.Load() == 25
+	}, time.Second, time.Millisecond)
+	// the waits overlap, the time is counted once
+	assert.Equal(t, time.Millisecond*1100, rl.Stats().Throttled)
+}
+
+func TestTCPConn_Limit(t *testing.T) {
+	mem := MemNet{}
+	client := newTestPeer(false)
+	depot := TCPDepot{Net: &mem, OutLimit: &RateLimit{RecordsPerSec: 1000}}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		if conn.RemoteAddr().String() == "limited" {
+			return client
+		}
+		return newTestPeer(true)
+	})
+	assert.Nil(t, depot.Listen("limited"))
+	defer depot.Close()
+	assert.Nil(t, depot.Connect("limited"))
+	in := &RateLimit{BytesPerSec: 1 << 20}
+	tcp := depot.Conn("limited")
+	tcp.Limit(nil, in)
+
+	// the depot-wide limit covers both the client and the echo side;
+	// a batch over the burst makes the next one wait
+	rec := Record('R', []byte("rate"))
+	for i := 0; i < 1100; i++ {
+		client.Send(toyqueue.Records{rec})
+	}
+	start := time.Now()
+	assert.Equal(t, 1100, len(client.Received(1100)))
+	assert.Greater(t, time.Since(start), time.Millisecond*50)
+	assert.Greater(t, depot.OutLimit.Stats().Throttled, time.Duration(0))
+	assert.Equal(t, int64(1100), in.Stats().Records)
+
+	// a limit of the connection's own, adjusted on the fly
+	depot.OutLimit.SetRate(0, 0)
+	tcp.SetRate(Outbound, 0, 1)
+	client.Send(toyqueue.Records{rec})
+	assert.Equal(t, 1101, len(client.Received(1101)))
+	client.Send(toyqueue.Records{rec}) // waits for a second
+	time.Sleep(time.Millisecond * 50)
+	client.mx.Lock()
+	assert.Equal(t, 1101, len(client.in))
+	client.mx.Unlock()
+	start = time.Now()
+	tcp.SetRate(Outbound, 0, 0)
+	assert.Equal(t, 1102, len(client.Received(1102)))
+	assert.Less(t, time.Since(start), time.Millisecond*500)
+}
@@ -3,35 +3,50 @@ package toytlv
 import (
 	"github.com/learn-decentralized-systems/toyqueue"
 	"io"
+	"net"
+	"syscall"
 )
 
 // Feeder reads TLV records from an io.Reader stream.
 // Note that Feeder is buffered, i.e. it reads ahead.
 // When doing Seek() on a file, recreate Feeder, that is cheap.
 type Reader2Feeder struct {
-	pre    []byte
-	Reader io.Reader
+	pre     []byte
+	Reader  io.Reader
+	Pool    *BufPool
+	Metrics Metrics
 }
 
 type ReadSeeker2FeedSeeker struct {
-	pre    []byte
-	Reader io.ReadSeeker
+	pre     []byte
+	Reader  io.ReadSeeker
+	Pool    *BufPool
+	Metrics Metrics
 }
 
 type ReadCloser2FeedCloser struct {
-	pre    []byte
-	Reader io.ReadCloser
+	pre     []byte
+	Reader  io.ReadCloser
+	Pool    *BufPool
+	Metrics Metrics
 }
 
 type ReadSeekCloser2FeedSeekCloser struct {
-	pre    []byte
-	Reader io.ReadSeekCloser
+	pre     []byte
+	Reader  io.ReadSeekCloser
+	Pool    *BufPool
+	Metrics Metrics
 }
 
 const DefaultPreBufLength = 4096
 const MinRecommendedRead = 512
 const MinRecommendedWrite = 400
 
+// MaxRecordLen limits the body length of the records read by feeders
+// and TCPConn: a longer one is ErrBadRecord, no buffer gets allocated
+// for it. May be raised (up to 0x7fffffff) before reading anything.
+var MaxRecordLen = 1 << 26
+
 func (fs *ReadSeeker2FeedSeeker) Seek(offset int64, whence int) (int64, error) {
 	fs.pre = nil
 	return fs.Reader.Seek(offset, whence)
@@ -53,26 +68,26 @@ func (fs *ReadSeekCloser2FeedSeekCloser) Close() error {
 }
 
 func (fs *Reader2Feeder) Feed() (recs toyqueue.Records, err error) {
-	fs.pre, recs, err = feed(fs.pre, fs.Reader)
+	fs.pre, recs, err = feed(fs.pre, fs.Reader, fs.Pool, fs.Metrics)
 	return
 }
 
 func (fs *ReadSeeker2FeedSeeker) Feed() (recs toyqueue.Records, err error) {
-	fs.pre, recs, err = feed(fs.pre, fs.Reader)
+	fs.pre, recs, err = feed(fs.pre, fs.Reader, fs.Pool, fs.Metrics)
 	return
 }
 
 func (fs *ReadCloser2FeedCloser) Feed() (recs toyqueue.Records, err error) {
-	fs.pre, recs, err = feed(fs.pre, fs.Reader)
+	fs.pre, recs, err = feed(fs.pre, fs.Reader, fs.Pool, fs.Metrics)
 	return
 }
 
 func (fs *ReadSeekCloser2FeedSeekCloser) Feed() (recs toyqueue.Records, err error) {
-	fs.pre, recs, err = feed(fs.pre, fs.Reader)
+	fs.pre, recs, err = feed(fs.pre, fs.Reader, fs.Pool, fs.Metrics)
 	return
 }
 
-func fill(past []byte, tolen int, reader io.Reader) (data []byte, err error) {
+func fill(past []byte, tolen int, reader io.Reader, pool *BufPool) (data []byte, err error) {
 	data = past
 	l := len(data)
 	c := cap(data)
@@ -81,8 +96,16 @@ func fill(past []byte, tolen int, reader io.Reader) (data []byte, err error) {
 		if newcap < tolen {
 			newcap = tolen
 		}
-		newpre := make([]byte, newcap)
-		copy(newpre, data)
+		var newpre []byte
+		if pool != nil {
+			newpre = pool.Get(newcap)
+			newpre = newpre[:cap(newpre)]
+			copy(newpre, data)
+			pool.Put(data)
+		} else {
+			newpre = make([]byte, newcap)
+			copy(newpre, data)
+		}
 		newpre = newpre[:l]
 		data = newpre
 		l = len(data)
@@ -92,47 +115,63 @@ func fill(past []byte, tolen int, reader io.Reader) (data []byte, err error) {
 		vac := data[l:c]
 		var n int
 		n, err = reader.Read(vac)
+		l += n
+		data = data[0:l]
 		if err != nil {
 			break
 		}
-		data = data[0 : l+n]
 	}
 	return
 }
 
-func feed(past []byte, reader io.Reader) (rest []byte, tlv toyqueue.Records, err error) {
+// feed reads as many complete records as available. With a pool,
+// records get detached from the read buffer, so the buffer gets reused.
+func feed(past []byte, reader io.Reader, pool *BufPool, metrics Metrics) (rest []byte, tlv toyqueue.Records, err error) {
 	rest = past
 	var hdrlen, bodylen int
 	var lit byte
 	lit, hdrlen, bodylen = ProbeHeader(rest)
-	for lit == 0 || hdrlen+bodylen > len(rest) {
+	for (lit == 0 || hdrlen+bodylen > len(rest)) && bodylen <= MaxRecordLen {
 		tolen := len(rest) + 1
 		if lit != 0 {
 			tolen = hdrlen + bodylen
 		}
-		rest, err = fill(rest, tolen, reader)
+		rest, err = fill(rest, tolen, reader, pool)
+		lit, hdrlen, bodylen = ProbeHeader(rest)
 		if err != nil {
-			return
+			break // return whatever is complete, then the error
 		}
-		lit, hdrlen, bodylen = ProbeHeader(rest)
 	}
-	for lit >= 'A' && lit <= 'Z' && hdrlen+bodylen <= len(rest) {
+	base := rest
+	for lit != 0 && lit != '-' && hdrlen+bodylen <= len(rest) && bodylen <= MaxRecordLen {
 		tlv = append(tlv, rest[0:hdrlen+bodylen])
 		rest = rest[hdrlen+bodylen:]
 		lit, hdrlen, bodylen = ProbeHeader(rest)
 	}
-	if lit == '-' {
-		err = ErrBadRecord
+	if pool != nil && len(tlv) > 0 {
+		pool.detach(tlv)
+		rest = base[:copy(base[:cap(base)], rest)]
+	}
+	if (lit == '-' || bodylen > MaxRecordLen) && err == nil {
+		err = ErrBadRecord // a read error says more
+	}
+	if metrics != nil {
+		metrics.Records(Inbound, tlv)
+		if err == ErrBadRecord {
+			metrics.ParseError(Inbound, err)
+		}
 	}
 	return
 }
 
 type Writer2Drainer struct {
-	Writer io.Writer
+	Writer  io.Writer
+	Metrics Metrics
 }
 
 type WritCloser2DrainCloser struct {
-	Writer io.WriteCloser
+	Writer  io.WriteCloser
+	Metrics Metrics
 }
 
 func next(rest []byte, more toyqueue.Records) (cur []byte, left toyqueue.Records) {
@@ -147,12 +186,25 @@ func next(rest []byte, more toyqueue.Records) (cur []byte, left toyqueue.Records
 	return
 }
 
-// Having no writev() we do the next best thing: bundle writes
-func (d *Writer2Drainer) Drain(recs toyqueue.Records) error {
+// drain writes records with no copying where possible: writev() for
+// files (Linux), net.Buffers for TCP and unix sockets. Other conns
+// (TLS, pipes) would take net.Buffers one Write per record, so these,
+// like anything else, get the next best thing: bundled writes.
+func drain(writer io.Writer, recs toyqueue.Records) error {
+	switch w := writer.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		b := append(net.Buffers(nil), recs...) // WriteTo consumes
+		_, err := b.WriteTo(w)
+		return err
+	case syscall.Conn:
+		if done, err := writev(w, recs); done {
+			return err
+		}
+	}
 	var cur []byte
 	for len(cur) > 0 || len(recs) > 0 {
 		cur, recs = next(cur, recs)
-		n, err := d.Writer.Write(cur)
+		n, err := writer.Write(cur)
 		if err != nil {
 			return err
 		}
@@ -161,18 +213,19 @@ func (d *Writer2Drainer) Drain(recs toyqueue.Records) error {
 	return nil
 }
 
-// Having no writev() we do the next best thing: bundle writes
+func (d *Writer2Drainer) Drain(recs toyqueue.Records) error {
+	return drained(drain(d.Writer, recs), recs, d.Metrics)
+}
+
 func (d *WritCloser2DrainCloser) Drain(recs toyqueue.Records) error {
-	var cur []byte
-	for len(cur) > 0 || len(recs) > 0 {
-		cur, recs = next(cur, recs)
-		n, err := d.Writer.Write(cur)
-		if err != nil {
-			return err
-		}
-		cur = cur[n:]
+	return drained(drain(d.Writer, recs), recs, d.Metrics)
+}
+
+func drained(err error, recs toyqueue.Records, metrics Metrics) error {
+	if err == nil && metrics != nil {
+		metrics.Records(Outbound, recs)
 	}
-	return nil
+	return err
 }
 
 func (dc *WritCloser2DrainCloser) Close() error {
@@ -0,0 +1,148 @@
+package toytlv
+
+import (
+	"bytes"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv/tlvtest"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func randomRecords(rnd *rand.Rand) (recs toyqueue.Records) {
+	n := rnd.Intn(50) + 1
+	for i := 0; i < n; i++ {
+		var body []byte
+		switch rnd.Intn(3) {
+		case 0:
+			body = make([]byte, rnd.Intn(10))
+		case 1:
+			body = make([]byte, rnd.Intn(256))
+		default:
+			body = make([]byte, rnd.Intn(3*DefaultPreBufLength))
+		}
+		rnd.Read(body)
+		lit := byte('A' + rnd.Intn(26))
+		switch {
+		case len(body) <= 9 && rnd.Intn(2) == 0:
+			recs = append(recs, TinyRecord(lit, body)) // digit literal
+		case rnd.Intn(2) == 0:
+			recs = append(recs, Record(lit, body))
+		default:
+			bm, rec := OpenHeader(nil, lit) // long form, always
+			rec = append(rec, body...)
+			CloseHeader(rec, bm)
+			recs = append(recs, rec)
+		}
+	}
+	return
+}
+
+func feedAll(feeder toyqueue.Feeder) (recs toyqueue.Records, err error) {
+	for i := 0; i < 1<<20; i++ {
+		var more toyqueue.Records
+		more, err = feeder.Feed()
+		recs = append(recs, more...)
+		if err != nil {
+			return
+		}
+	}
+	return recs, io.ErrNoProgress
+}
+
+var faultyReaders = map[string]func(r io.Reader) io.Reader{
+	"plain":   func(r io.Reader) io.Reader { return r },
+	"onebyte": tlvtest.OneByteReader,
+	"zero":    tlvtest.ZeroReader,
+	"chunks":  func(r io.Reader) io.Reader { return tlvtest.ChunkReader(r, 1, 7, 300, 4097, 2) },
+}
+
+func TestFraming_FaultyIO(t *testing.T) {
+	rnd := rand.New(rand.NewSource(38))
+	for round := 0; round < 30; round++ {
+		recs := randomRecords(rnd)
+		data := Concat(recs...)
+
+		buf := bytes.Buffer{}
+		short := Writer2Drainer{Writer: tlvtest.ShortWriter(&buf, 1+rnd.Intn(100))}
+		assert.Nil(t, short.Drain(recs))
+		assert.Equal(t, data, buf.Bytes())
+
+		for name, faulty := range faultyReaders {
+			feeder := Reader2Feeder{Reader: faulty(bytes.NewReader(data))}
+			got, err := feedAll(&feeder)
+			assert.Equal(t, io.EOF, err, name)
+			assert.Equal(t, recs, got, name)
+		}
+
+		// an error in the middle: all the complete records get through
+		cut := rnd.Intn(len(data))
+		feeder := Reader2Feeder{
+			Reader: tlvtest.ErrAfterReader(tlvtest.OneByteReader(bytes.NewReader(data)), cut, tlvtest.ErrInjected),
+		}
+		got, err := feedAll(&feeder)
+		assert.Equal(t, tlvtest.ErrInjected, err)
+		complete, _, _ := Split(data[:cut])
+		assert.Equal(t, len(complete), len(got))
+		assert.Equal(t, Concat(complete...), Concat(got...))
+	}
+}
+
+func TestReader2Feeder_ReadError(t *testing.T) {
+	// garbage and a read error at once: the read error is the news
+	feeder := Reader2Feeder{Reader: iotest.DataErrReader(
+		tlvtest.ErrAfterReader(bytes.NewReader([]byte("!garbage")), 8, tlvtest.ErrInjected))}
+	_, err := feeder.Feed()
+	assert.Equal(t, tlvtest.ErrInjected, err)
+
+	feeder = Reader2Feeder{Reader: bytes.NewReader([]byte("!garbage"))}
+	_, err = feeder.Feed()
+	assert.Equal(t, ErrBadRecord, err)
+}
+
+func TestReader2Feeder_MaxRecordLen(t *testing.T) {
+	huge := AppendHeader(nil, 'B', MaxRecordLen+1)
+	feeder := Reader2Feeder{Reader: bytes.NewReader(Concat(Record('A', []byte("ok")), huge))}
+	recs, err := feeder.Feed()
+	assert.Equal(t, ErrBadRecord, err)
+	assert.Equal(t, 1, len(recs))
+}
+
+func TestWriter2Drainer_Error(t *testing.T) {
+	buf := bytes.Buffer{}
+	d := Writer2Drainer{Writer: tlvtest.ErrAfterWriter(&buf, 10, tlvtest.ErrInjected)}
+	err := d.Drain(Records('A', make([]byte, 20)))
+	assert.Equal(t, tlvtest.ErrInjected, err)
+	assert.Equal(t, 10, buf.Len())
+}
+
+// countConn counts the writes that reach a net.Conn
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+func TestWriter2Drainer_Bundles(t *testing.T) {
+	// a conn that is no socket (TLS, a pipe) gets bundled writes,
+	// not one write per record
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := &countConn{Conn: a}
+	recs := Records('A', make([]byte, 10), make([]byte, 10), make([]byte, 10))
+	go func() {
+		_ = (&Writer2Drainer{Writer: conn}).Drain(recs)
+		_ = a.Close()
+	}()
+	data, err := io.ReadAll(b)
+	assert.Nil(t, err)
+	assert.Equal(t, Concat(recs...), data)
+	assert.Equal(t, 1, conn.writes)
+}
@@ -0,0 +1,250 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Middleware wraps a handler, e.g. to log, validate or count records.
+type Middleware func(next toyqueue.Drainer) toyqueue.Drainer
+
+// Router dispatches incoming records to handlers by the record type,
+// so a Jack may return a Router instead of switching on Lit(rec).
+// Handlers that are Feeders too get their output merged into the
+// Router's Feed, i.e. sent to the peer; their Feed must block till
+// there is output or an error. A handler is any Drainer; the same
+// one given for several types is told by ==, if its type is comparable,
+// otherwise every Handle call registers a handler of its own.
+type Router struct {
+	// Default gets the records nobody handles; if nil, those are
+	// an error. Default is never fed from.
+	Default toyqueue.Drainer
+
+	mx       sync.Mutex
+	co       sync.Cond
+	handlers map[byte]*handling
+	feeding  map[int]bool
+	gen      int
+	def      toyqueue.Drainer // the Default that defWrapped wraps
+	defWrap  toyqueue.Drainer
+	mws      []Middleware
+	out      toyqueue.Records
+	err      error
+	closed   bool
+}
+
+// handling is a handler as registered; the id tells handlers apart,
+// as their types may be not comparable
+type handling struct {
+	handler toyqueue.Drainer
+	wrapped toyqueue.Drainer
+	id      int
+}
+
+func (r *Router) init() {
+	if r.handlers == nil {
+		r.co.L = &r.mx
+		r.handlers = make(map[byte]*handling)
+		r.feeding = make(map[int]bool)
+	}
+}
+
+// same tells whether the two are the same handler, with no panics
+// for the types that are not comparable
+func same(a, b toyqueue.Drainer) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	return va.Type() == vb.Type() && va.Comparable() && vb.Comparable() && va.Equal(vb)
+}
+
+func (r *Router) wrap(handler toyqueue.Drainer) toyqueue.Drainer {
+	for i := len(r.mws) - 1; i >= 0; i-- {
+		handler = r.mws[i](handler)
+	}
+	return handler
+}
+
+// Handle routes the records of the type to the handler. A handler
+// may serve several types; then, it is fed from once. A replaced
+// handler that serves no type anymore is closed, if a Closer, and
+// no longer fed from.
+func (r *Router) Handle(lit byte, handler toyqueue.Drainer) {
+	lit = Lit([]byte{lit})
+	r.mx.Lock()
+	r.init()
+	h := &handling{handler: handler, wrapped: r.wrap(handler)}
+	for _, other := range r.handlers {
+		if same(other.handler, handler) {
+			h.id = other.id
+		}
+	}
+	if h.id == 0 {
+		r.gen++
+		h.id = r.gen
+	}
+	old := r.handlers[lit]
+	r.handlers[lit] = h
+	var gone toyqueue.Drainer
+	if old != nil && !r.serves(old.id) {
+		gone = old.handler
+		delete(r.feeding, old.id)
+	}
+	feeder, start := handler.(toyqueue.Feeder)
+	start = start && !r.feeding[h.id]
+	if start {
+		r.feeding[h.id] = true
+	}
+	r.mx.Unlock()
+	if closer, ok := gone.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	if start {
+		go r.merge(feeder, h.id)
+	}
+}
+
+// serves tells whether the handler serves any type; the caller holds
+// the lock
+func (r *Router) serves(id int) bool {
+	for _, h := range r.handlers {
+		if h.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Use adds middleware to all the handlers, Default included.
+// The middleware added first is the outermost.
+func (r *Router) Use(mw ...Middleware) {
+	r.mx.Lock()
+	r.init()
+	r.mws = append(r.mws, mw...)
+	for _, h := range r.handlers {
+		h.wrapped = r.wrap(h.handler)
+	}
+	r.def, r.defWrap = nil, nil
+	r.mx.Unlock()
+}
+
+// merge moves the handler's output to the router's, till the handler
+// is replaced; a handler's error goes to the router's Feed
+func (r *Router) merge(feeder toyqueue.Feeder, id int) {
+	for {
+		recs, err := feeder.Feed()
+		r.mx.Lock()
+		if r.closed || !r.feeding[id] {
+			r.mx.Unlock()
+			return
+		}
+		r.out = append(r.out, recs...)
+		if err != nil && r.err == nil {
+			r.err = err
+		}
+		r.co.Broadcast()
+		r.mx.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// route finds the handler, wrapped; Default is wrapped once, till
+// it or the middleware changes
+func (r *Router) route(lit byte) toyqueue.Drainer {
+	if h, ok := r.handlers[lit]; ok {
+		return h.wrapped
+	}
+	if r.Default == nil {
+		return nil
+	}
+	if r.defWrap == nil || !same(r.def, r.Default) {
+		r.def, r.defWrap = r.Default, r.wrap(r.Default)
+	}
+	return r.defWrap
+}
+
+// Drain routes the records; consecutive records of a handler go
+// in one batch, the order is kept.
+func (r *Router) Drain(recs toyqueue.Records) error {
+	r.mx.Lock()
+	r.init()
+	var handlers []toyqueue.Drainer
+	var batches []toyqueue.Records
+	for i := 0; i < len(recs); {
+		if len(recs[i]) == 0 {
+			r.mx.Unlock()
+			return ErrBadRecord
+		}
+		handler := r.route(Lit(recs[i]))
+		if handler == nil {
+			r.mx.Unlock()
+			return ErrBadRecord
+		}
+		j := i + 1
+		for j < len(recs) && len(recs[j]) > 0 && Lit(recs[j]) == Lit(recs[i]) {
+			j++
+		}
+		handlers = append(handlers, handler)
+		batches = append(batches, recs[i:j])
+		i = j
+	}
+	r.mx.Unlock()
+	for i, handler := range handlers {
+		if err := handler.Drain(batches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Feed returns the handlers' output. Once a handler's Feed fails,
+// so does the router's, after the output still pending.
+func (r *Router) Feed() (recs toyqueue.Records, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.init()
+	for len(r.out) == 0 && r.err == nil && !r.closed {
+		r.co.Wait()
+	}
+	if r.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	if len(r.out) == 0 {
+		return nil, r.err
+	}
+	recs, r.out = r.out, nil
+	return
+}
+
+// Close closes the router and the handlers that are Closers.
+func (r *Router) Close() (err error) {
+	r.mx.Lock()
+	r.init()
+	r.closed = true
+	r.co.Broadcast()
+	var closers []io.Closer
+	closed := make(map[int]bool)
+	dflt := true
+	for _, h := range r.handlers {
+		if closer, ok := h.handler.(io.Closer); ok && !closed[h.id] {
+			closed[h.id] = true
+			closers = append(closers, closer)
+		}
+		dflt = dflt && !same(h.handler, r.Default)
+	}
+	if closer, ok := r.Default.(io.Closer); ok && dflt {
+		closers = append(closers, closer)
+	}
+	r.mx.Unlock()
+	for _, closer := range closers {
+		if cerr := closer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package toytlv
+
+import (
+	"errors"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// routeSink is a plain Drainer, it keeps what it gets
+type routeSink struct {
+	mx   sync.Mutex
+	recs toyqueue.Records
+}
+
+func (rs *routeSink) Drain(recs toyqueue.Records) error {
+	rs.mx.Lock()
+	rs.recs = append(rs.recs, recs...)
+	rs.mx.Unlock()
+	return nil
+}
+
+type countDrainer struct {
+	next  toyqueue.Drainer
+	count *int
+}
+
+func (cd countDrainer) Drain(recs toyqueue.Records) error {
+	*cd.count += len(recs)
+	return cd.next.Drain(recs)
+}
+
+func TestRouter(t *testing.T) {
+	r := Router{}
+	a, b, def := routeSink{}, newTestPeer(false), routeSink{}
+	r.Handle('A', &a)
+	r.Handle('b', b)
+	r.Handle('C', b)
+	count := 0
+	r.Use(func(next toyqueue.Drainer) toyqueue.Drainer {
+		return countDrainer{next: next, count: &count}
+	})
+
+	recs := toyqueue.Records{
+		Record('A', []byte("1")),
+		Record('B', []byte("2")),
+		Record('A', []byte("3")),
+		Record('C', []byte("4")),
+		Record('D', []byte("5")),
+	}
+	assert.Equal(t, ErrBadRecord, r.Drain(recs))
+	assert.Equal(t, 0, len(a.recs))
+	r.Default = &def
+	assert.Nil(t, r.Drain(recs))
+	assert.Equal(t, toyqueue.Records{recs[0], recs[2]}, a.recs)
+	assert.Equal(t, toyqueue.Records{recs[1], recs[3]}, b.Received(2))
+	assert.Equal(t, toyqueue.Records{recs[4]}, def.recs)
+	assert.Equal(t, 5, count)
+
+	// b is a Feeder: its output goes out
+	b.Send(toyqueue.Records{Record('R', []byte("reply"))})
+	out, err := r.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, toyqueue.Records{Record('R', []byte("reply"))}, out)
+
+	assert.Nil(t, r.Close())
+	_, err = r.Feed()
+	assert.Equal(t, toyqueue.ErrClosed, err)
+	b.mx.Lock()
+	assert.True(t, b.closed)
+	b.mx.Unlock()
+}
+
+// failFeeder fails its Feed once told to
+type failFeeder struct {
+	routeSink
+	err chan error
+}
+
+func (ff *failFeeder) Feed() (toyqueue.Records, error) {
+	return nil, <-ff.err
+}
+
+func TestRouter_FeedError(t *testing.T) {
+	r := Router{}
+	b := newTestPeer(false)
+	f := &failFeeder{err: make(chan error, 1)}
+	r.Handle('B', b)
+	r.Handle('F', f)
+	b.Send(toyqueue.Records{Record('R', []byte("reply"))})
+	out, err := r.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(out))
+	failed := errors.New("handler failed")
+	f.err <- failed
+	_, err = r.Feed()
+	assert.Equal(t, failed, err)
+	_ = r.Close()
+}
+
+func TestRouter_Replace(t *testing.T) {
+	r := Router{}
+	old, cur := newTestPeer(false), newTestPeer(false)
+	r.Handle('A', old)
+	r.Handle('B', old)
+	r.Handle('A', cur)
+	old.mx.Lock()
+	assert.False(t, old.closed) // still serves B
+	old.mx.Unlock()
+	r.Handle('B', cur)
+	old.mx.Lock()
+	assert.True(t, old.closed)
+	old.mx.Unlock()
+	// the old merge is gone, not an error
+	cur.Send(toyqueue.Records{Record('R', []byte("reply"))})
+	out, err := r.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, toyqueue.Records{Record('R', []byte("reply"))}, out)
+	_ = r.Close()
+}
+
+// drainFunc is a handler of a type that is not comparable
+type drainFunc func(recs toyqueue.Records) error
+
+func (df drainFunc) Drain(recs toyqueue.Records) error {
+	return df(recs)
+}
+
+func TestRouter_Incomparable(t *testing.T) {
+	r := Router{}
+	got := 0
+	f := drainFunc(func(recs toyqueue.Records) error {
+		got += len(recs)
+		return nil
+	})
+	r.Handle('A', f)
+	r.Handle('B', f)
+	r.Handle('A', f)
+	r.Default = f
+	assert.Nil(t, r.Drain(Records('A', nil, nil)))
+	assert.Nil(t, r.Drain(Records('C', nil)))
+	assert.Nil(t, r.Drain(Records('C', nil)))
+	assert.Equal(t, 4, got)
+	assert.Nil(t, r.Close())
+}
+
+func TestRouter_DefaultWrappedOnce(t *testing.T) {
+	r := Router{}
+	wraps := 0
+	r.Use(func(next toyqueue.Drainer) toyqueue.Drainer {
+		wraps++
+		return next
+	})
+	def, other := routeSink{}, routeSink{}
+	r.Default = &def
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, r.Drain(Records('A', nil)))
+	}
+	assert.Equal(t, 1, wraps)
+	assert.Equal(t, 3, len(def.recs))
+	r.Default = &other
+	assert.Nil(t, r.Drain(Records('A', nil)))
+	assert.Equal(t, 2, wraps)
+	assert.Equal(t, 1, len(other.recs))
+}
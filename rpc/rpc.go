@@ -0,0 +1,342 @@
+// Package rpc is request/response calls over toytlv connections.
+// A call is a 'Q' record: the call ID (uvarint), the method letter,
+// the argument. The reply is an 'R' record: the call ID, the status
+// byte, the result (or the error message). A caller that gave up
+// sends an 'N' record with the call ID, so the handler gets canceled.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/learn-decentralized-systems/toytlv"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	CallLit   = 'Q'
+	ReplyLit  = 'R'
+	CancelLit = 'N'
+)
+
+const (
+	StatusOK = iota
+	StatusError
+	StatusNoMethod
+)
+
+var ErrNoMethod = errors.New("rpc: no such method")
+
+// RemoteError is an error returned by the remote handler.
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return "rpc: " + string(e)
+}
+
+// Handler serves calls of a method. The context is canceled if the
+// caller gives up.
+type Handler func(ctx context.Context, arg []byte) (result []byte, err error)
+
+// Client calls methods of the peers and serves the peers' calls;
+// the peers are equal. Use Client.Jack for a TCPDepot, then Call a
+// connection by its remote address or, if Depot is set, by any
+// address the depot knows it by (see TCPDepot.Conn).
+type Client struct {
+	// Timeout limits a call unless the context has a deadline; 0 for none
+	Timeout time.Duration
+	// Depot, if set, resolves the addresses to Call
+	Depot *toytlv.TCPDepot
+
+	mx       sync.Mutex
+	handlers map[byte]Handler
+	sessions map[string]*session
+	seq      uint64
+}
+
+type reply struct {
+	result []byte
+	err    error
+}
+
+// session is the inout of one connection
+type session struct {
+	client  *Client
+	addr    string
+	mx      sync.Mutex
+	co      sync.Cond
+	out     toyqueue.Records
+	calls   map[uint64]chan reply
+	serving map[uint64]context.CancelFunc
+	closed  bool
+}
+
+// Handle registers the handler of a method letter.
+func (c *Client) Handle(method byte, handler Handler) {
+	c.mx.Lock()
+	if c.handlers == nil {
+		c.handlers = make(map[byte]Handler)
+	}
+	c.handlers[method] = handler
+	c.mx.Unlock()
+}
+
+func (c *Client) handler(method byte) Handler {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.handlers[method]
+}
+
+// Jack is a toytlv.Jack making an RPC session per connection.
+func (c *Client) Jack(conn net.Conn) toyqueue.FeedDrainCloser {
+	s := &session{
+		client:  c,
+		addr:    conn.RemoteAddr().String(),
+		calls:   make(map[uint64]chan reply),
+		serving: make(map[uint64]context.CancelFunc),
+	}
+	s.co.L = &s.mx
+	c.mx.Lock()
+	if c.sessions == nil {
+		c.sessions = make(map[string]*session)
+	}
+	c.sessions[s.addr] = s
+	c.mx.Unlock()
+	return s
+}
+
+// Call calls a method of the peer at addr and waits for the result.
+func (c *Client) Call(ctx context.Context, addr string, method byte, arg []byte) ([]byte, error) {
+	if c.Depot != nil {
+		if tcp := c.Depot.Conn(addr); tcp != nil {
+			if conn := tcp.NetConn(); conn != nil {
+				addr = conn.RemoteAddr().String()
+			}
+		}
+	}
+	c.mx.Lock()
+	s, ok := c.sessions[addr]
+	c.seq++
+	id := c.seq
+	c.mx.Unlock()
+	if !ok {
+		return nil, toytlv.ErrAddressUnknown
+	}
+	if _, has := ctx.Deadline(); !has && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	done := make(chan reply, 1)
+	body := binary.AppendUvarint(nil, id)
+	body = append(body, method)
+	body = append(body, arg...)
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return nil, toyqueue.ErrClosed
+	}
+	s.calls[id] = done
+	s.send(toytlv.Record(CallLit, body))
+	s.mx.Unlock()
+	select {
+	case re := <-done:
+		return re.result, re.err
+	case <-ctx.Done():
+		s.mx.Lock()
+		if _, ok := s.calls[id]; ok {
+			delete(s.calls, id)
+			if !s.closed {
+				s.send(toytlv.Record(CancelLit, binary.AppendUvarint(nil, id)))
+			}
+		}
+		s.mx.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// send queues a record; the caller holds the lock
+func (s *session) send(rec []byte) {
+	s.out = append(s.out, rec)
+	s.co.Broadcast()
+}
+
+func (s *session) Feed() (recs toyqueue.Records, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for len(s.out) == 0 && !s.closed {
+		s.co.Wait()
+	}
+	if s.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	recs, s.out = s.out, nil
+	return
+}
+
+func (s *session) Drain(recs toyqueue.Records) error {
+	for _, rec := range recs {
+		lit, body, rest, err := toytlv.TakeAnyWary(rec)
+		if err != nil || len(rest) != 0 {
+			return toytlv.ErrBadRecord
+		}
+		id, n := binary.Uvarint(body)
+		if n <= 0 {
+			return toytlv.ErrBadRecord
+		}
+		body = body[n:]
+		switch lit {
+		case CallLit:
+			if len(body) == 0 {
+				return toytlv.ErrBadRecord
+			}
+			s.serve(id, body[0], body[1:])
+		case ReplyLit:
+			if len(body) == 0 {
+				return toytlv.ErrBadRecord
+			}
+			s.reply(id, body[0], body[1:])
+		case CancelLit:
+			s.mx.Lock()
+			cancel := s.serving[id]
+			s.mx.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+		default:
+			return toytlv.ErrBadRecord
+		}
+	}
+	return nil
+}
+
+func (s *session) serve(id uint64, method byte, arg []byte) {
+	handler := s.client.handler(method)
+	if handler == nil {
+		s.respond(id, StatusNoMethod, nil)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mx.Lock()
+	s.serving[id] = cancel
+	s.mx.Unlock()
+	arg = append([]byte(nil), arg...)
+	go func() {
+		result, err := handler(ctx, arg)
+		s.mx.Lock()
+		delete(s.serving, id)
+		s.mx.Unlock()
+		if ctx.Err() != nil {
+			return // the caller is gone
+		}
+		cancel()
+		if err != nil {
+			s.respond(id, StatusError, []byte(err.Error()))
+		} else {
+			s.respond(id, StatusOK, result)
+		}
+	}()
+}
+
+func (s *session) respond(id uint64, status byte, result []byte) {
+	body := binary.AppendUvarint(nil, id)
+	body = append(body, status)
+	body = append(body, result...)
+	s.mx.Lock()
+	if !s.closed {
+		s.send(toytlv.Record(ReplyLit, body))
+	}
+	s.mx.Unlock()
+}
+
+func (s *session) reply(id uint64, status byte, result []byte) {
+	s.mx.Lock()
+	done, ok := s.calls[id]
+	delete(s.calls, id)
+	s.mx.Unlock()
+	if !ok {
+		return // canceled
+	}
+	switch status {
+	case StatusOK:
+		done <- reply{result: append([]byte(nil), result...)}
+	case StatusNoMethod:
+		done <- reply{err: ErrNoMethod}
+	default:
+		done <- reply{err: RemoteError(result)}
+	}
+}
+
+// abort fails the pending calls, cancels the handlers; the caller
+// holds the lock
+func (s *session) abort(err error) {
+	for id, done := range s.calls {
+		done <- reply{err: err}
+		delete(s.calls, id)
+	}
+	for _, cancel := range s.serving {
+		cancel()
+	}
+}
+
+// Reconnected fails the calls made before: the peer is a fresh one,
+// it knows nothing about them. What is queued for the old peer is
+// dropped; the calls the writer may have taken already get canceled,
+// as they may reach the new peer. The session lives on, under the new
+// remote address.
+func (s *session) Reconnected(conn net.Conn) {
+	s.mx.Lock()
+	queued := make(map[uint64]bool)
+	for _, rec := range s.out {
+		if lit, body, _, err := toytlv.TakeAnyWary(rec); err == nil && lit == CallLit {
+			id, _ := binary.Uvarint(body)
+			queued[id] = true
+		}
+	}
+	s.out = nil
+	for id := range s.calls {
+		if !queued[id] {
+			s.send(toytlv.Record(CancelLit, binary.AppendUvarint(nil, id)))
+		}
+	}
+	s.abort(toytlv.ErrDisconnected)
+	old := s.addr
+	s.addr = conn.RemoteAddr().String()
+	s.mx.Unlock()
+	c := s.client
+	c.mx.Lock()
+	if c.sessions[old] == s {
+		delete(c.sessions, old)
+	}
+	c.sessions[s.addr] = s
+	c.mx.Unlock()
+}
+
+// Disconnected closes the session, the connection is over.
+func (s *session) Disconnected() {
+	_ = s.Close()
+}
+
+// Close fails the pending calls, cancels the handlers.
+func (s *session) Close() error {
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.abort(toyqueue.ErrClosed)
+	s.co.Broadcast()
+	addr := s.addr
+	s.mx.Unlock()
+	c := s.client
+	c.mx.Lock()
+	if c.sessions[addr] == s {
+		delete(c.sessions, addr)
+	}
+	c.mx.Unlock()
+	return nil
+}
@@ -0,0 +1,162 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/learn-decentralized-systems/toytlv"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClient_Call(t *testing.T) {
+	mem := toytlv.MemNet{}
+	server := Client{}
+	server.Handle('E', func(ctx context.Context, arg []byte) ([]byte, error) {
+		return arg, nil
+	})
+	server.Handle('F', func(ctx context.Context, arg []byte) ([]byte, error) {
+		return nil, errors.New("failed")
+	})
+	canceled := make(chan struct{})
+	server.Handle('S', func(ctx context.Context, arg []byte) ([]byte, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	sdepot := toytlv.TCPDepot{Net: &mem}
+	sdepot.Open(server.Jack)
+	assert.Nil(t, sdepot.Listen("rpc"))
+	defer sdepot.Close()
+
+	client := Client{Timeout: time.Millisecond * 50}
+	cdepot := toytlv.TCPDepot{Net: &mem}
+	cdepot.Open(client.Jack)
+	defer cdepot.Close()
+	assert.Nil(t, cdepot.Connect("rpc"))
+
+	ctx := context.Background()
+	result, err := client.Call(ctx, "rpc", 'E', []byte("echo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", string(result))
+
+	_, err = client.Call(ctx, "rpc", 'F', nil)
+	assert.Equal(t, RemoteError("failed"), err)
+	_, err = client.Call(ctx, "rpc", 'X', nil)
+	assert.Equal(t, ErrNoMethod, err)
+	_, err = client.Call(ctx, "nowhere", 'E', nil)
+	assert.Equal(t, toytlv.ErrAddressUnknown, err)
+
+	// the timeout cancels the handler
+	_, err = client.Call(ctx, "rpc", 'S', nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the handler is not canceled")
+	}
+
+	// concurrent calls
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		arg := []byte{byte(i)}
+		go func() {
+			result, err := client.Call(ctx, "rpc", 'E', arg)
+			if err == nil && string(result) != string(arg) {
+				err = errors.New("mixed up")
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func echoServer(t *testing.T, depot *toytlv.TCPDepot, addr string) {
+	server := Client{}
+	server.Handle('E', func(ctx context.Context, arg []byte) ([]byte, error) {
+		return arg, nil
+	})
+	depot.Open(server.Jack)
+	assert.Nil(t, depot.Listen(addr))
+}
+
+func TestClient_Depot(t *testing.T) {
+	// the depot knows the address dialed, the jack gets a resolved one
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	_, port, _ := net.SplitHostPort(lstn.Addr().String())
+	_ = lstn.Close()
+	sdepot := toytlv.TCPDepot{}
+	echoServer(t, &sdepot, "127.0.0.1:"+port)
+	defer sdepot.Close()
+
+	cdepot := toytlv.TCPDepot{}
+	client := Client{Timeout: time.Second, Depot: &cdepot}
+	cdepot.Open(client.Jack)
+	defer cdepot.Close()
+	addr := "localhost:" + port
+	assert.Nil(t, cdepot.Connect(addr))
+	result, err := client.Call(context.Background(), addr, 'E', []byte("hi"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hi", string(result))
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	mem := toytlv.MemNet{}
+	sdepot := toytlv.TCPDepot{Net: &mem}
+	echoServer(t, &sdepot, "rpc")
+	defer sdepot.Close()
+
+	cdepot := toytlv.TCPDepot{Net: &mem, Reconnect: true}
+	client := Client{Timeout: time.Millisecond * 100, Depot: &cdepot}
+	cdepot.Open(client.Jack)
+	defer cdepot.Close()
+	assert.Nil(t, cdepot.Connect("rpc"))
+	ctx := context.Background()
+	_, err := client.Call(ctx, "rpc", 'E', nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, mem.Break("rpc"))
+	assert.Eventually(t, func() bool {
+		result, err := client.Call(ctx, "rpc", 'E', []byte("again"))
+		return err == nil && string(result) == "again"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSession_Reconnected(t *testing.T) {
+	client := Client{Timeout: time.Second}
+	conn, _ := net.Pipe()
+	inout := client.Jack(conn)
+	s := inout.(*session)
+	queued := func() int {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		return len(s.out)
+	}
+	errs := make(chan error, 2)
+	call := func() {
+		_, err := client.Call(context.Background(), "pipe", 'E', nil)
+		errs <- err
+	}
+	go call()
+	assert.Eventually(t, func() bool { return queued() == 1 }, time.Second, time.Millisecond)
+	taken, err := inout.Feed() // the writer has it
+	assert.Nil(t, err)
+	go call()
+	assert.Eventually(t, func() bool { return queued() == 1 }, time.Second, time.Millisecond)
+
+	s.Reconnected(conn)
+	assert.Equal(t, toytlv.ErrDisconnected, <-errs)
+	assert.Equal(t, toytlv.ErrDisconnected, <-errs)
+	// the queued call is gone, the taken one is canceled
+	recs, err := inout.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recs))
+	_, sent, _, _ := toytlv.TakeAnyWary(taken[0])
+	cancel, _, _ := toytlv.TakeWary(CancelLit, recs[0])
+	assert.Equal(t, sent[:len(cancel)], cancel) // the same ID
+	_ = inout.Close()
+}
@@ -0,0 +1,380 @@
+package toytlv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"net"
+	"sync"
+)
+
+// SealLit is the record type reserved for sealed (encrypted) envelopes.
+// An 'E' record body is the nonce followed by the AEAD-sealed
+// concatenation of TLV records; the nonce is also the additional data.
+// The nonce starts with the sequence number of the envelope, a
+// little-endian uint64; the rest of it is zeros. SealJack derives its
+// nonces from the salts instead, see there.
+const SealLit = 'E'
+
+// SaltLit is the record type reserved for the salts SealJack
+// connections start with.
+const SaltLit = 'S'
+
+// SaltLen is the length of a SealJack salt.
+const SaltLen = 16
+
+var ErrBadSeal = errors.New("sealed record fails authentication")
+var ErrReplay = errors.New("sealed record replayed or reordered")
+var ErrUnsealed = errors.New("unsealed record in a sealed stream")
+var ErrNonceSize = errors.New("AEAD nonce is shorter than 8 bytes")
+
+// NewAEAD creates an AES-GCM cipher; the key is 16, 24 or 32 bytes.
+// Any other cipher.AEAD (e.g. ChaCha20-Poly1305) works as well.
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealDrainer encrypts every batch into one 'E' envelope record.
+// Nonces are a counter, so never use the same key for two streams
+// (or two directions of a stream), unless Seq is carried over.
+type SealDrainer struct {
+	Drainer toyqueue.Drainer
+	AEAD    cipher.AEAD
+	// Seq is the sequence number of the last sealed envelope
+	Seq uint64
+}
+
+// UnsealFeeder authenticates and decrypts 'E' envelopes. Envelopes
+// must go strictly in sequence, so replays and reordering get rejected,
+// just as any unsealed records.
+type UnsealFeeder struct {
+	Feeder toyqueue.Feeder
+	AEAD   cipher.AEAD
+	// Seq is the sequence number of the last accepted envelope
+	Seq uint64
+}
+
+func sealNonce(aead cipher.AEAD, seq uint64) ([]byte, error) {
+	if aead.NonceSize() < 8 {
+		return nil, ErrNonceSize
+	}
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, seq)
+	return nonce, nil
+}
+
+// Seal encrypts records into an envelope record with the given
+// sequence number.
+func Seal(aead cipher.AEAD, seq uint64, recs toyqueue.Records) ([]byte, error) {
+	nonce, err := sealNonce(aead, seq)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, nonce, nil, recs), nil
+}
+
+// seal seals the records; the additional data is the nonce, then ad
+func seal(aead cipher.AEAD, nonce, ad []byte, recs toyqueue.Records) []byte {
+	plain := Concat(recs...)
+	body := make([]byte, len(nonce), len(nonce)+len(plain)+aead.Overhead())
+	copy(body, nonce)
+	body = aead.Seal(body, nonce, plain, append(nonce[:len(nonce):len(nonce)], ad...))
+	return Record(SealLit, body)
+}
+
+// Unseal decrypts an envelope record, returns its sequence number
+// and the records inside.
+func Unseal(aead cipher.AEAD, envelope []byte) (seq uint64, recs toyqueue.Records, err error) {
+	nonce, recs, err := open(aead, envelope, nil)
+	if nonce == nil || err == ErrBadSeal {
+		return 0, nil, err
+	}
+	return binary.LittleEndian.Uint64(nonce), recs, err
+}
+
+// open is Unseal with more additional data; it returns the nonce
+// once the envelope is found to have one, authentic or not
+func open(aead cipher.AEAD, envelope, ad []byte) (nonce []byte, recs toyqueue.Records, err error) {
+	if Lit(envelope) != SealLit {
+		return nil, nil, ErrUnsealed
+	}
+	body, rest, err := TakeWary(SealLit, envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := aead.NonceSize()
+	if size < 8 {
+		return nil, nil, ErrNonceSize
+	}
+	if len(rest) != 0 || len(body) < size+aead.Overhead() {
+		return nil, nil, ErrBadRecord
+	}
+	nonce = body[:size]
+	plain, err := aead.Open(nil, nonce, body[size:], append(nonce[:size:size], ad...))
+	if err != nil {
+		return nonce, nil, ErrBadSeal
+	}
+	recs, rest, err = Split(plain)
+	if err == nil && len(rest) != 0 {
+		err = ErrBadRecord
+	}
+	return
+}
+
+func (sd *SealDrainer) Drain(recs toyqueue.Records) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	envelope, err := Seal(sd.AEAD, sd.Seq+1, recs)
+	if err != nil {
+		return err
+	}
+	sd.Seq++
+	return sd.Drainer.Drain(toyqueue.Records{envelope})
+}
+
+func unsealAll(aead cipher.AEAD, last *uint64, envelopes toyqueue.Records) (res toyqueue.Records, err error) {
+	for _, env := range envelopes {
+		seq, recs, err := Unseal(aead, env)
+		if err != nil {
+			return res, err
+		}
+		if seq != *last+1 {
+			return res, ErrReplay
+		}
+		*last = seq
+		res = append(res, recs...)
+	}
+	return
+}
+
+func (uf *UnsealFeeder) Feed() (recs toyqueue.Records, err error) {
+	recs, err = uf.Feeder.Feed()
+	if len(recs) == 0 {
+		return
+	}
+	var uerr error
+	recs, uerr = unsealAll(uf.AEAD, &uf.Seq, recs)
+	if uerr != nil {
+		err = uerr
+	}
+	return
+}
+
+type sealInOut struct {
+	inout        toyqueue.FeedDrainCloser
+	seal, unseal cipher.AEAD
+	mx           sync.Mutex
+	co           sync.Cond
+	salt         []byte // ours, fresh for every connection
+	peer         []byte // the peer's, nil till it comes
+	salted       bool   // ours is sent
+	send, recv   []byte // the nonce bases, nil till the peer salt comes
+	sealed       uint64 // envelopes sealed on this connection
+	opened       uint64 // envelopes opened on this connection
+	queue        toyqueue.Records
+	err          error
+	closed       bool
+}
+
+// SealJack wraps a Jack to encrypt a TCPConn's traffic. The keys
+// function supplies the ciphers for every new connection, one for each
+// direction. Every connection, and every reconnect too, starts with
+// both sides sending an 'S' record, a random salt. The nonces of each
+// direction are derived from both salts, so envelopes recorded on one
+// connection fail on any other (and in the other direction), as does
+// any envelope replayed or reordered. Envelopes sealed for a connection
+// that broke are dropped. The nonce must be 8 bytes or more, the more
+// the better; AES-GCM has 12. Random salts make the nonces random, so
+// the keys are only as good as random nonces are: prefer distinct keys
+// for distinct peers, and replace keys before their AEAD's limit on
+// random nonces, which is 2^32 connections for AES-GCM.
+func SealJack(jack Jack, keys func(conn net.Conn) (seal, unseal cipher.AEAD)) Jack {
+	return func(conn net.Conn) toyqueue.FeedDrainCloser {
+		seal, unseal := keys(conn)
+		s := &sealInOut{
+			inout:  jack(conn),
+			seal:   seal,
+			unseal: unseal,
+		}
+		s.co.L = &s.mx
+		s.reset()
+		go s.pump()
+		return s
+	}
+}
+
+// reset picks a fresh salt, forgets the peer's; the caller holds
+// the lock.
+func (s *sealInOut) reset() {
+	s.salt = make([]byte, SaltLen)
+	_, _ = rand.Read(s.salt)
+	s.peer, s.send, s.recv = nil, nil, nil
+	s.salted = false
+	s.sealed, s.opened = 0, 0
+	s.co.Broadcast()
+}
+
+// nonceBase derives the nonces of the envelopes from one salt to
+// another; the first 8 bytes are a counter base.
+func nonceBase(aead cipher.AEAD, from, to []byte) []byte {
+	sum := sha256.Sum256(append(from[:len(from):len(from)], to...))
+	base := make([]byte, aead.NonceSize())
+	copy(base, sum[:])
+	return base
+}
+
+// nonceAt is the nonce of the n-th envelope
+func nonceAt(base []byte, n uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	binary.LittleEndian.PutUint64(nonce, binary.LittleEndian.Uint64(base)+n)
+	return nonce
+}
+
+// pump takes records from the inout, a batch at a time
+func (s *sealInOut) pump() {
+	for {
+		s.mx.Lock()
+		for len(s.queue) > 0 && !s.closed {
+			s.co.Wait()
+		}
+		closed := s.closed
+		s.mx.Unlock()
+		if closed {
+			return
+		}
+		recs, err := s.inout.Feed()
+		s.mx.Lock()
+		s.queue = append(s.queue, recs...)
+		if err != nil {
+			s.err = err
+		}
+		s.co.Broadcast()
+		s.mx.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *sealInOut) Drain(recs toyqueue.Records) error {
+	var opened toyqueue.Records
+	s.mx.Lock()
+	for _, rec := range recs {
+		if len(rec) > 0 && Lit(rec) == SaltLit {
+			if err := s.takeSalt(rec); err != nil {
+				s.mx.Unlock()
+				return err
+			}
+			continue
+		}
+		if s.recv == nil {
+			continue // sealed for a connection before this one
+		}
+		nonce, inner, err := open(s.unseal, rec, s.salt)
+		if err == ErrBadSeal && !bytes.Equal(nonce[8:], s.recv[8:]) {
+			continue // not for this connection either
+		}
+		if err == nil && !bytes.Equal(nonce, nonceAt(s.recv, s.opened+1)) {
+			err = ErrReplay
+		}
+		if err != nil {
+			s.mx.Unlock()
+			return err
+		}
+		s.opened++
+		opened = append(opened, inner...)
+	}
+	s.mx.Unlock()
+	if len(opened) == 0 {
+		return nil
+	}
+	return s.inout.Drain(opened)
+}
+
+// takeSalt takes the peer's salt. A salt sent before a reconnect may
+// come first, so a later one replaces it till an envelope is opened;
+// the sealing goes on counting, so no nonce repeats. The caller holds
+// the lock.
+func (s *sealInOut) takeSalt(rec []byte) error {
+	body, rest, err := TakeWary(SaltLit, rec)
+	if err == nil && (len(rest) != 0 || len(body) != SaltLen) {
+		err = ErrBadRecord
+	}
+	if err == nil && s.opened > 0 {
+		err = ErrReplay
+	}
+	if err != nil {
+		return err
+	}
+	s.peer = append([]byte(nil), body...)
+	s.send = nonceBase(s.seal, s.salt, s.peer)
+	s.recv = nonceBase(s.unseal, s.peer, s.salt)
+	s.co.Broadcast()
+	return nil
+}
+
+// Feed sends our salt first, then envelopes, once the peer's salt is
+// known.
+func (s *sealInOut) Feed() (recs toyqueue.Records, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for {
+		if s.closed {
+			return nil, toyqueue.ErrClosed
+		}
+		if !s.salted {
+			s.salted = true
+			return toyqueue.Records{Record(SaltLit, s.salt)}, nil
+		}
+		if len(s.queue) > 0 && s.send != nil {
+			break
+		}
+		if len(s.queue) == 0 && s.err != nil {
+			return nil, s.err
+		}
+		s.co.Wait()
+	}
+	if s.seal.NonceSize() < 8 {
+		return nil, ErrNonceSize
+	}
+	s.sealed++
+	nonce := nonceAt(s.send, s.sealed)
+	recs = toyqueue.Records{seal(s.seal, nonce, s.peer, s.queue)}
+	s.queue = nil
+	s.co.Broadcast()
+	return
+}
+
+// Reconnected starts both directions afresh, as the peer does.
+func (s *sealInOut) Reconnected(conn net.Conn) {
+	s.mx.Lock()
+	s.reset()
+	s.mx.Unlock()
+	if re, ok := s.inout.(Reconnecter); ok {
+		re.Reconnected(conn)
+	}
+}
+
+func (s *sealInOut) Disconnected() {
+	if dis, ok := s.inout.(Disconnecter); ok {
+		dis.Disconnected()
+	}
+}
+
+func (s *sealInOut) Close() error {
+	s.mx.Lock()
+	s.closed = true
+	s.co.Broadcast()
+	s.mx.Unlock()
+	return s.inout.Close()
+}
@@ -0,0 +1,163 @@
+package toytlv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+type testQueue struct {
+	recs toyqueue.Records
+}
+
+func (tf *testQueue) Drain(recs toyqueue.Records) error {
+	tf.recs = append(tf.recs, recs...)
+	return nil
+}
+
+func (tf *testQueue) Feed() (recs toyqueue.Records, err error) {
+	recs, tf.recs = tf.recs, nil
+	return
+}
+
+func TestSealDrainer(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	aead, err := NewAEAD(key)
+	assert.Nil(t, err)
+	wire := testQueue{}
+	sd := SealDrainer{Drainer: &wire, AEAD: aead}
+	assert.Nil(t, sd.Drain(Join(Record('A', []byte("secret")), Record('B', []byte("more")))))
+	assert.Nil(t, sd.Drain(Join(Record('C', []byte("even more")))))
+	assert.Equal(t, 2, len(wire.recs))
+	assert.NotContains(t, string(wire.recs[0]), "secret")
+	envelopes := wire.recs
+
+	aead2, _ := NewAEAD(key)
+	uf := UnsealFeeder{Feeder: &wire, AEAD: aead2}
+	recs, err := uf.Feed()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(recs))
+	lit, body, _ := TakeAny(recs[0])
+	assert.Equal(t, uint8('A'), lit)
+	assert.Equal(t, "secret", string(body))
+
+	// replay
+	_ = wire.Drain(envelopes[1:])
+	_, err = uf.Feed()
+	assert.Equal(t, ErrReplay, err)
+
+	// tamper
+	uf.Seq = 0
+	bad := Concat(envelopes[0])
+	bad[len(bad)-1] ^= 1
+	_ = wire.Drain(Join(bad))
+	_, err = uf.Feed()
+	assert.Equal(t, ErrBadSeal, err)
+
+	// plaintext
+	_ = wire.Drain(Join(Record('A', []byte("plain"))))
+	_, err = uf.Feed()
+	assert.Equal(t, ErrUnsealed, err)
+}
+
+func TestSeal_NonceSize(t *testing.T) {
+	block, _ := aes.NewCipher([]byte("0123456789abcdef"))
+	aead, err := cipher.NewGCMWithNonceSize(block, 4)
+	assert.Nil(t, err)
+	_, err = Seal(aead, 1, Join(Record('A', []byte("a"))))
+	assert.Equal(t, ErrNonceSize, err)
+	sd := SealDrainer{Drainer: &testQueue{}, AEAD: aead}
+	assert.Equal(t, ErrNonceSize, sd.Drain(Join(Record('A', []byte("a")))))
+}
+
+// sealPair makes two SealJack inouts, as if connected, salts sent
+func sealPair(t *testing.T, aead cipher.AEAD) (a, b toyqueue.FeedDrainCloser, pa, pb *testPeer) {
+	pa, pb = newTestPeer(false), newTestPeer(false)
+	keys := func(conn net.Conn) (seal, unseal cipher.AEAD) {
+		return aead, aead
+	}
+	a = SealJack(func(conn net.Conn) toyqueue.FeedDrainCloser { return pa }, keys)(nil)
+	b = SealJack(func(conn net.Conn) toyqueue.FeedDrainCloser { return pb }, keys)(nil)
+	for _, dir := range [][2]toyqueue.FeedDrainCloser{{a, b}, {b, a}} {
+		salt, err := dir[0].Feed()
+		assert.Nil(t, err)
+		assert.Equal(t, byte(SaltLit), Lit(salt[0]))
+		assert.Nil(t, dir[1].Drain(salt))
+	}
+	return
+}
+
+func TestSealJack_Replay(t *testing.T) {
+	// the same key for every connection and direction
+	aead, err := NewAEAD([]byte("0123456789abcdef"))
+	assert.Nil(t, err)
+	a, b, pa, pb := sealPair(t, aead)
+	pa.Send(Join(Record('A', []byte("once"))))
+	one, err := a.Feed()
+	assert.Nil(t, err)
+	pa.Send(Join(Record('A', []byte("twice"))))
+	two, err := a.Feed()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(one[0]), "once")
+	assert.Nil(t, b.Drain(one))
+	assert.Equal(t, Record('A', []byte("once")), pb.Received(1)[0])
+
+	// reflected back, recorded and replayed on a new connection
+	assert.Nil(t, a.Drain(one))
+	_, d, _, pd := sealPair(t, aead)
+	assert.Nil(t, d.Drain(Join(one[0], two[0])))
+	assert.Equal(t, 0, len(pd.in))
+	pa.mx.Lock()
+	assert.Equal(t, 0, len(pa.in))
+	pa.mx.Unlock()
+
+	// replayed, reordered or salted anew on the same connection
+	assert.Equal(t, ErrReplay, b.Drain(one))
+	salt := Record(SaltLit, make([]byte, SaltLen))
+	assert.Equal(t, ErrReplay, b.Drain(Join(salt)))
+	assert.Nil(t, b.Drain(two))
+	assert.Equal(t, 2, len(pb.Received(2)))
+}
+
+func TestSealJack_Reconnect(t *testing.T) {
+	// the same key for every connection and direction
+	aead, err := NewAEAD([]byte("0123456789abcdef"))
+	assert.Nil(t, err)
+	keys := func(conn net.Conn) (seal, unseal cipher.AEAD) {
+		return aead, aead
+	}
+	mem := MemNet{}
+	server := TCPDepot{Net: &mem}
+	server.Open(SealJack(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newTestPeer(true)
+	}, keys))
+	assert.Nil(t, server.Listen("sealed"))
+	defer server.Close()
+
+	client := newTestPeer(false)
+	depot := TCPDepot{Net: &mem, Reconnect: true}
+	depot.Open(SealJack(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return client
+	}, keys))
+	assert.Nil(t, depot.Connect("sealed"))
+	defer depot.Close()
+
+	client.Send(Join(Record('A', []byte("before"))))
+	assert.Equal(t, 1, len(client.Received(1)))
+	tcp := depot.Conn("sealed")
+	old := tcp.NetConn()
+	assert.Equal(t, 2, mem.Break("sealed"))
+	// what is sealed for the broken connection is lost with it
+	assert.Eventually(t, func() bool {
+		conn := tcp.NetConn()
+		return conn != nil && conn != old
+	}, time.Second*5, time.Millisecond)
+	client.Send(Join(Record('A', []byte("after"))))
+	recs := client.Received(2)
+	assert.Equal(t, 2, len(recs))
+	assert.Equal(t, Record('A', []byte("after")), recs[1])
+}
@@ -1,12 +1,13 @@
 package toytlv
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"github.com/learn-decentralized-systems/toyqueue"
 	"io"
+	"log/slog"
 	"net"
-	"os"
 	"sync"
 	"time"
 )
@@ -16,16 +17,49 @@ const MaxOutQueueLen = 1 << 20 // 16MB of pointers is a lot
 type TCPConn struct {
 	depot     *TCPDepot
 	addr      string
+	key       string
+	outbound  bool
+	stopped   bool
 	conn      net.Conn
 	inout     toyqueue.FeedDrainCloser
 	wake      *sync.Cond
 	outmx     sync.Mutex
+	out       *Coalescer
+	coalesce  int
+	delay     time.Duration
+	shake     *Handshake
+	outLimit  *RateLimit
+	inLimit   *RateLimit
+	lanes     *Lanes
 	Reconnect bool
 	KeepAlive bool
 }
 
 type Jack func(conn net.Conn) toyqueue.FeedDrainCloser
 
+// Reconnecter is an inout that wants to know when its connection is
+// re-established, e.g. to restate its state to the (fresh) peer.
+// The inout stays the same across reconnects. Reconnected is called
+// before anything is written to the new connection.
+type Reconnecter interface {
+	Reconnected(conn net.Conn)
+}
+
+// Disconnecter is an inout that wants to know when its connection is
+// over for good: an accepted one is closed, an outbound one is closed
+// or broken with no Reconnect. The depot itself neither closes the
+// inout nor forgets the connection then; both stay till Close.
+type Disconnecter interface {
+	Disconnected()
+}
+
+// Network is what TCPDepot dials and listens with, TCP by default.
+// MemNet is an in-process alternative for tests.
+type Network interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
 // A TCP server/client for the use case of real-time async communication.
 // Differently from the case of request-response (like HTTP), we do not
 // wait for a request, then dedicating a thread to processing, then sending
@@ -35,31 +69,78 @@ type Jack func(conn net.Conn) toyqueue.FeedDrainCloser
 // event transmission to all the other receivers.
 type TCPDepot struct {
 	conns   map[string]*TCPConn
+	addrs   map[string]string // address to key, where the two differ
 	listens map[string]net.Listener
 	conmx   sync.Mutex
+	closed  bool
 	jack    Jack
+	// Pool, if set, is used for incoming records; see BufPool
+	Pool *BufPool
+	// Net, if set, replaces TCP
+	Net Network
+	// Hello, if set, is exchanged before anything else; connections
+	// to peers that do not agree get rejected
+	Hello *Hello
+	// OutLimit and InLimit, if set, limit the traffic of all the
+	// connections together; see also TCPConn.Limit
+	OutLimit *RateLimit
+	InLimit  *RateLimit
+	// Metrics, if set, gets the numbers of all the connections
+	Metrics Metrics
+	// Logger, if set, gets the events of the connections: failures,
+	// reconnects, etc. The depot never writes to stderr by itself.
+	Logger *slog.Logger
+	// Reconnect is the TCPConn.Reconnect of the connections made by
+	// Connect, set before they start talking
+	Reconnect bool
+	// Lanes, if set, makes the Lanes of a connection: the records its
+	// inout feeds go out by priority; see TCPConn.Lanes
+	Lanes func(conn net.Conn) *Lanes
+}
+
+func (de *TCPDepot) dial(addr string) (net.Conn, error) {
+	if de.Net != nil {
+		return de.Net.Dial(addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// plug makes the inout of a connection, and its Lanes if any
+func (de *TCPDepot) plug(conn net.Conn) (toyqueue.FeedDrainCloser, *Lanes) {
+	inout := de.jack(conn)
+	if de.Lanes == nil {
+		return inout, nil
+	}
+	li := newLanesInout(inout, de.Lanes(conn))
+	return li, li.lanes
 }
 
 func (de *TCPDepot) Open(jack Jack) {
 	de.conmx.Lock()
 	de.conns = make(map[string]*TCPConn)
+	de.addrs = make(map[string]string)
 	de.listens = make(map[string]net.Listener)
+	de.closed = false
 	de.conmx.Unlock()
 	de.jack = jack
 }
 
+// Close closes the listeners and the connections, no reconnects;
+// connections that come after that are refused.
 func (de *TCPDepot) Close() {
-	for _, lstn := range de.listens {
-		_ = lstn.Close()
-	}
-	de.listens = nil
-	for _, con := range de.conns {
-		con.Close()
-	}
 	de.conmx.Lock()
+	de.closed = true
+	listens, conns := de.listens, de.conns
 	de.conns = make(map[string]*TCPConn)
+	de.addrs = make(map[string]string)
 	de.listens = make(map[string]net.Listener)
 	de.conmx.Unlock()
+	for _, lstn := range listens {
+		_ = lstn.Close()
+	}
+	for _, con := range conns {
+		con.halt()
+	}
 }
 
 func (tcp *TCPConn) Close() {
@@ -78,38 +159,158 @@ var ErrAddressUnknown = errors.New("address unknown")
 const MAX_RETRY_PERIOD = time.Minute
 const MIN_RETRY_PERIOD = time.Second / 2
 
+// PeerKey is the key of a connection to a peer whose ID is known
+// from the handshake; see Conn, DrainTo, Disconnect.
+func PeerKey(id []byte) string {
+	return hex.EncodeToString(id)
+}
+
+func connKey(addr string, shake *Handshake) string {
+	if shake != nil && len(shake.PeerID) > 0 {
+		return PeerKey(shake.PeerID)
+	}
+	return addr
+}
+
+// enlist adds a connection to the depot. Connections are keyed by
+// the peer ID if known, by the address otherwise. Of two connections
+// to the same peer, the one initiated by the node with the lesser ID
+// stays; else, the newer one. Returns false if the new one loses.
+// Either way, the address leads to the one that stays.
+func (de *TCPDepot) enlist(tcp *TCPConn) bool {
+	de.conmx.Lock()
+	if de.closed {
+		de.conmx.Unlock()
+		return false
+	}
+	if tcp.key != tcp.addr {
+		de.addrs[tcp.addr] = tcp.key
+	}
+	old, ok := de.conns[tcp.key]
+	if ok && old != tcp && old.outbound != tcp.outbound && !de.prefers(tcp) {
+		de.conmx.Unlock()
+		return false
+	}
+	de.conns[tcp.key] = tcp
+	de.conmx.Unlock()
+	if ok && old != tcp {
+		old.stop()
+	}
+	return true
+}
+
+func (de *TCPDepot) prefers(tcp *TCPConn) bool {
+	if de.Hello == nil || tcp.shake == nil {
+		return true
+	}
+	lesser := bytes.Compare(de.Hello.NodeID, tcp.shake.PeerID) < 0
+	return tcp.outbound == lesser
+}
+
 // attrib?!
 func (de *TCPDepot) Connect(addr string) (err error) {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := de.dial(addr)
+	if err != nil {
+		return err
+	}
+	shake, err := de.handshake(conn)
 	if err != nil {
+		kind := ErrKind(err)
+		de.log(level(kind), "handshake failed", "addr", addr, "outbound", true,
+			"kind", kind, "err", err)
+		_ = conn.Close()
 		return err
 	}
 	peer := TCPConn{
-		depot: de,
-		conn:  conn,
-		addr:  addr,
-		inout: de.jack(conn),
+		depot:     de,
+		conn:      conn,
+		addr:      addr,
+		key:       connKey(addr, shake),
+		outbound:  true,
+		shake:     shake,
+		Reconnect: de.Reconnect,
 	}
+	peer.inout, peer.lanes = de.plug(conn)
 	peer.wake = sync.NewCond(&peer.outmx)
-	de.conmx.Lock()
-	de.conns[addr] = &peer
-	de.conmx.Unlock()
+	if !de.enlist(&peer) {
+		peer.stop()
+		if de.isClosed() {
+			return toyqueue.ErrClosed
+		}
+		peer.log(slog.LevelDebug, "duplicate connection dropped", "key", peer.key)
+		return nil // already connected
+	}
 	go peer.KeepTalking()
 	return nil
 }
 
+func (de *TCPDepot) isClosed() bool {
+	de.conmx.Lock()
+	defer de.conmx.Unlock()
+	return de.closed
+}
+
+// halt closes the connection for good, no reconnects
+func (tcp *TCPConn) halt() {
+	tcp.outmx.Lock()
+	tcp.stopped = true
+	tcp.wake.Broadcast()
+	tcp.outmx.Unlock()
+	tcp.Close()
+}
+
+// stop halts the connection, closes its inout
+func (tcp *TCPConn) stop() {
+	tcp.halt()
+	_ = tcp.inout.Close()
+}
+
+func (tcp *TCPConn) isStopped() bool {
+	tcp.outmx.Lock()
+	defer tcp.outmx.Unlock()
+	return tcp.stopped
+}
+
+// rekey re-enlists a reconnected connection, if the peer is different
+func (tcp *TCPConn) rekey() bool {
+	de := tcp.depot
+	key := connKey(tcp.addr, tcp.Handshake())
+	if key == tcp.key {
+		return true
+	}
+	de.conmx.Lock()
+	if de.conns[tcp.key] == tcp {
+		delete(de.conns, tcp.key)
+	}
+	tcp.key = key
+	de.conmx.Unlock()
+	return de.enlist(tcp)
+}
+
 var ErrDisconnected = errors.New("disconnected by user")
 
+func (tcp *TCPConn) getConn() net.Conn {
+	tcp.outmx.Lock()
+	defer tcp.outmx.Unlock()
+	return tcp.conn
+}
+
+// NetConn returns the current network connection, the one the Jack
+// got (or the Reconnecter); nil while reconnecting.
+func (tcp *TCPConn) NetConn() net.Conn {
+	return tcp.getConn()
+}
+
 func (tcp *TCPConn) KeepTalking() {
 	talk_backoff := MIN_RETRY_PERIOD
 	conn_backoff := MIN_RETRY_PERIOD
+	go tcp.doWrite()
 	for {
 
 		conntime := time.Now()
-		go tcp.doWrite()
 		err := tcp.Read()
 
-		if !tcp.Reconnect {
+		if !tcp.Reconnect || tcp.isStopped() {
 			break
 		}
 
@@ -121,20 +322,62 @@ func (tcp *TCPConn) KeepTalking() {
 			}
 		}
 
-		for tcp.conn == nil {
+		for tcp.getConn() == nil && !tcp.isStopped() {
 			time.Sleep(conn_backoff + talk_backoff)
-			tcp.conn, err = net.Dial("tcp", tcp.addr)
+			var conn net.Conn
+			var shake *Handshake
+			conn, err = tcp.depot.dial(tcp.addr)
+			if err == nil {
+				shake, err = tcp.depot.handshake(conn)
+				if err != nil {
+					_ = conn.Close()
+				}
+			}
 			if err != nil {
+				tcp.log(slog.LevelDebug, "reconnect failed", "kind", ErrKind(err), "err", err)
 				conn_backoff = conn_backoff * 2
 				if conn_backoff > MAX_RETRY_PERIOD/2 {
 					conn_backoff = MAX_RETRY_PERIOD
 				}
 			} else {
+				tcp.outmx.Lock()
+				if tcp.stopped { // halted while dialing
+					tcp.outmx.Unlock()
+					_ = conn.Close()
+					break
+				}
+				tcp.shake = shake
+				tcp.outmx.Unlock()
 				conn_backoff = MIN_RETRY_PERIOD
+				if m := tcp.depot.Metrics; m != nil {
+					m.Reconnect(tcp.addr)
+				}
+				tcp.log(slog.LevelInfo, "reconnected")
+				if !tcp.rekey() {
+					_ = conn.Close()
+					tcp.stop()
+					break
+				}
+				// the inout learns of the new peer before the writer does
+				if re, ok := tcp.inout.(Reconnecter); ok {
+					re.Reconnected(conn)
+				}
+				tcp.outmx.Lock()
+				if !tcp.stopped {
+					tcp.conn = conn
+					tcp.wake.Broadcast()
+				} else {
+					_ = conn.Close()
+				}
+				tcp.outmx.Unlock()
 			}
 		}
+		if tcp.isStopped() {
+			break
+		}
 
 	}
+	tcp.over()
 }
 
 // Write what we believe is a valid ToyTLV frame.
@@ -155,9 +398,34 @@ func (tcp *TCPConn) Feed() (recs toyqueue.Records, err error) {
 	return tcp.inout.Feed()
 }
 
+// find looks a connection up by its key or, failing that, by its
+// address; the caller holds conmx
+func (de *TCPDepot) find(key string) (*TCPConn, bool) {
+	if tcp, ok := de.conns[key]; ok {
+		return tcp, true
+	}
+	if k, ok := de.addrs[key]; ok {
+		if tcp, ok := de.conns[k]; ok {
+			return tcp, true
+		}
+		delete(de.addrs, key) // the connection is gone
+	}
+	return nil, false
+}
+
+// Conn returns the connection to addr, if any. The connections to
+// peers that said their IDs in the handshake are keyed by PeerKey;
+// the address works too.
+func (de *TCPDepot) Conn(addr string) *TCPConn {
+	de.conmx.Lock()
+	defer de.conmx.Unlock()
+	tcp, _ := de.find(addr)
+	return tcp
+}
+
 func (de *TCPDepot) DrainTo(recs toyqueue.Records, addr string) error {
 	de.conmx.Lock()
-	conn, ok := de.conns[addr]
+	conn, ok := de.find(addr)
 	de.conmx.Unlock()
 	if !ok {
 		return ErrAddressUnknown
@@ -167,20 +435,32 @@ func (de *TCPDepot) DrainTo(recs toyqueue.Records, addr string) error {
 
 func (de *TCPDepot) Disconnect(addr string) (err error) {
 	de.conmx.Lock()
-	tcp, ok := de.conns[addr]
+	tcp, ok := de.find(addr)
 	de.conmx.Unlock()
 	if !ok {
 		return ErrAddressUnknown
 	}
-	tcp.Close()
+	tcp.halt()
 	de.conmx.Lock()
-	delete(de.conns, addr)
+	if de.conns[tcp.key] == tcp {
+		delete(de.conns, tcp.key)
+	}
 	de.conmx.Unlock()
 	return nil
 }
 
+// DrainToPeer sends records to the peer with the ID; see PeerKey.
+func (de *TCPDepot) DrainToPeer(recs toyqueue.Records, id []byte) error {
+	return de.DrainTo(recs, PeerKey(id))
+}
+
 func (de *TCPDepot) Listen(addr string) (err error) {
-	listener, err := net.Listen("tcp", addr)
+	var listener net.Listener
+	if de.Net != nil {
+		listener, err = de.Net.Listen(addr)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
 		return
 	}
@@ -216,78 +496,257 @@ func (de *TCPDepot) KeepListening(addr string) {
 		}
 		conn, err := listener.Accept()
 		if err != nil {
+			de.log(slog.LevelDebug, "stopped listening", "addr", addr, "err", err)
 			break
 		}
-		addr := conn.RemoteAddr().String()
-		peer := TCPConn{
-			depot: de,
-			conn:  conn,
-			addr:  addr,
-			inout: de.jack(conn),
+		go de.accept(conn)
+	}
+}
+
+func (de *TCPDepot) accept(conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	shake, err := de.handshake(conn)
+	if err != nil {
+		kind := ErrKind(err)
+		de.log(level(kind), "handshake failed", "addr", addr, "outbound", false,
+			"kind", kind, "err", err)
+		_ = conn.Close()
+		return
+	}
+	peer := TCPConn{
+		depot: de,
+		conn:  conn,
+		addr:  addr,
+		key:   connKey(addr, shake),
+		shake: shake,
+	}
+	peer.inout, peer.lanes = de.plug(conn)
+	peer.wake = sync.NewCond(&peer.outmx)
+	if !de.enlist(&peer) {
+		peer.stop()
+		if !de.isClosed() {
+			peer.log(slog.LevelDebug, "duplicate connection dropped", "key", peer.key)
 		}
-		peer.wake = sync.NewCond(&peer.outmx)
-		de.conmx.Lock()
-		de.conns[addr] = &peer
-		de.conmx.Unlock()
+		return
+	}
 
-		go peer.doWrite()
-		go peer.doRead()
+	go peer.doWrite()
+	go peer.doRead()
+}
 
-	}
+// Lanes returns the Lanes the connection sends through, nil if the
+// depot has no Lanes. Records drained into a lane go out along with
+// the inout's, e.g. a ping on LaneControl overtakes the bulk.
+func (tcp *TCPConn) Lanes() *Lanes {
+	return tcp.lanes
+}
+
+// Handshake returns the parameters agreed upon with the peer,
+// nil if the depot has no Hello.
+func (tcp *TCPConn) Handshake() *Handshake {
+	tcp.outmx.Lock()
+	defer tcp.outmx.Unlock()
+	return tcp.shake
 }
 
 func (tcp *TCPConn) doRead() {
-	err := tcp.Read()
-	if err != nil && err != ErrDisconnected {
+	_ = tcp.Read()
+	tcp.over()
+}
+
+// over tells a Disconnecter its connection is over
+func (tcp *TCPConn) over() {
+	if dis, ok := tcp.inout.(Disconnecter); ok {
+		dis.Disconnected()
+	}
+}
+
+// Limit sets the rate limits of the connection, outbound and inbound;
+// nil is no limit. The limits of the depot apply as well. Limiting
+// the inbound traffic slows down reading, so TCP pushes back.
+func (tcp *TCPConn) Limit(out, in *RateLimit) {
+	tcp.outmx.Lock()
+	tcp.outLimit = out
+	tcp.inLimit = in
+	tcp.outmx.Unlock()
+}
+
+// SetRate adjusts the connection's own limit on the fly, making one
+// if there is none; zeros are no limit. See RateLimit.SetRate.
+func (tcp *TCPConn) SetRate(dir Direction, bytesPerSec, recordsPerSec int) {
+	tcp.outmx.Lock()
+	limit := &tcp.inLimit
+	if dir == Outbound {
+		limit = &tcp.outLimit
+	}
+	if *limit == nil {
+		*limit = &RateLimit{}
+	}
+	rl := *limit
+	tcp.outmx.Unlock()
+	rl.SetRate(bytesPerSec, recordsPerSec)
+}
+
+func (tcp *TCPConn) throttle(recs toyqueue.Records, outbound bool) {
+	tcp.outmx.Lock()
+	conn, depot := tcp.inLimit, tcp.depot.InLimit
+	if outbound {
+		conn, depot = tcp.outLimit, tcp.depot.OutLimit
 	}
+	tcp.outmx.Unlock()
+	conn.Wait(recs)
+	depot.Wait(recs)
 }
 
+// Coalesce makes the connection accumulate outgoing records till
+// there are threshold bytes pending or delay passes; see Coalescer.
+// Zeros turn coalescing off.
+func (tcp *TCPConn) Coalesce(threshold int, delay time.Duration) {
+	tcp.outmx.Lock()
+	tcp.coalesce = threshold
+	tcp.delay = delay
+	out := tcp.out
+	tcp.outmx.Unlock()
+	if out != nil {
+		out.SetLimits(threshold, delay)
+	}
+}
+
+// waitConn returns the current connection, waiting for a reconnect
+// if one is coming; nil if the connection is over for good
+func (tcp *TCPConn) waitConn() net.Conn {
+	tcp.outmx.Lock()
+	defer tcp.outmx.Unlock()
+	for tcp.conn == nil && tcp.Reconnect && !tcp.stopped {
+		tcp.wake.Wait()
+	}
+	return tcp.conn
+}
+
+// closeConn closes the connection if it is still the current one
+func (tcp *TCPConn) closeConn(conn net.Conn) {
+	if tcp.getConn() == conn {
+		tcp.Close()
+	}
+}
+
+// doWrite is the writer of a TCPConn, one for all its reconnects:
+// records fed while reconnecting wait for the new connection.
 func (tcp *TCPConn) doWrite() {
-	conn := tcp.conn
+	var conn net.Conn
+	var out *Coalescer
 	var err error
 	var recs toyqueue.Records
-	for conn != nil && err == nil {
+	var offset int64
+	depth := 0 // as reported to the Metrics, which sum up the changes
+	defer func() {
+		if m := tcp.depot.Metrics; m != nil && depth != 0 {
+			m.QueueDepth(Outbound, -depth)
+		}
+	}()
+	for err == nil {
 		recs, err = tcp.inout.Feed()
-		b := net.Buffers(recs)
-		for len(b) > 0 && err == nil {
-			_, err = b.WriteTo(conn)
+		if len(recs) == 0 {
+			continue
+		}
+		next := tcp.waitConn()
+		if next == nil {
+			return
+		}
+		if next != conn {
+			conn, offset = next, 0
+			tcp.outmx.Lock()
+			out = &Coalescer{
+				Drainer:   &Writer2Drainer{Writer: conn},
+				Threshold: tcp.coalesce,
+				Delay:     tcp.delay,
+			}
+			tcp.out = out
+			tcp.outmx.Unlock()
+		}
+		tcp.throttle(recs, true)
+		derr := out.Drain(recs)
+		if m := tcp.depot.Metrics; m != nil && derr == nil {
+			n := tcp.queued(out)
+			m.QueueDepth(Outbound, n-depth)
+			depth = n
+			m.Records(Outbound, recs)
+		}
+		if derr == nil {
+			offset += int64(TotalLen(recs))
+		} else {
+			tcp.logErr(Outbound, ErrKind(derr), offset, derr)
+			tcp.closeConn(conn)
 		}
 	}
-	if err != nil {
-		tcp.Close() // TODO err
+	if conn == nil {
+		tcp.Close()
+		return
+	}
+	if ferr := out.Flush(); ferr != nil {
+		err = ferr
+	}
+	tcp.logErr(Outbound, ErrKind(err), offset, err)
+	tcp.closeConn(conn)
+}
+
+// queued is the number of records fed, not written yet: coalesced
+// or waiting in the Lanes
+func (tcp *TCPConn) queued(out *Coalescer) int {
+	n := out.Pending()
+	if tcp.lanes != nil {
+		n += tcp.lanes.Len()
 	}
+	return n
 }
 
 const TYPICAL_MTU = 1500
 
 func (tcp *TCPConn) Read() (err error) {
 	var buf []byte
-	conn := tcp.conn
+	var offset int64 // of buf[0] in the stream
+	kind := ""
+	conn := tcp.getConn()
 	for conn != nil {
 		buf, err = AppendRead(buf, conn, TYPICAL_MTU)
 		if err != nil {
 			break
 		}
+		base := buf
 		var recs toyqueue.Records
 		recs, buf, err = Split(buf)
-		if len(recs) == 0 {
-			time.Sleep(time.Millisecond)
-			continue
+		offset += int64(TotalLen(recs))
+		if lit, _, bodylen := ProbeHeader(buf); err == nil && (lit == '-' || bodylen > MaxRecordLen) {
+			err = ErrBadRecord // no use reading more
 		}
-		if err != nil {
-			break
+		if len(recs) > 0 {
+			if pool := tcp.depot.Pool; pool != nil {
+				pool.detach(recs)
+				buf = base[:copy(base[:cap(base)], buf)]
+			}
+			if m := tcp.depot.Metrics; m != nil {
+				m.Records(Inbound, recs)
+			}
+			tcp.throttle(recs, false)
+			if derr := tcp.inout.Drain(recs); derr != nil {
+				err, kind = derr, KindInout
+			}
 		}
-
-		err = tcp.inout.Drain(recs)
 		if err != nil {
+			if m := tcp.depot.Metrics; m != nil && kind == "" {
+				m.ParseError(Inbound, err)
+			}
 			break
 		}
 
-		conn = tcp.conn
+		conn = tcp.getConn()
 	}
 
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, err.Error())
+		if kind == "" {
+			kind = ErrKind(err)
+		}
+		tcp.logErr(Inbound, kind, offset, err)
 		tcp.Close()
 	}
 	return
@@ -3,9 +3,11 @@ package toytlv
 import (
 	"github.com/learn-decentralized-systems/toyqueue"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"net"
 	"sync"
 	"testing"
+	"time"
 )
 
 // 1. create a server, create a client, echo
@@ -43,16 +45,16 @@ func (c *TestConsumer) Close() error {
 
 func TestTCPDepot_Connect(t *testing.T) {
 
-	loop := "127.0.0.1:12345"
+	loop := "loop:12345"
 
 	tc := TestConsumer{}
 	tc.co.L = &tc.mx
-	depot := TCPDepot{}
-	addr := ""
+	depot := TCPDepot{Net: &MemNet{}}
+	accepted := make(chan string, 1)
 	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
 		a := conn.RemoteAddr().String()
 		if a != loop {
-			addr = a
+			accepted <- a
 		}
 		return &tc
 	})
@@ -74,6 +76,10 @@ func TestTCPDepot_Connect(t *testing.T) {
 
 	// respond to that
 	recsback := toyqueue.Records{Record('M', []byte("Re: Hi there"))}
+	addr := <-accepted
+	assert.Eventually(t, func() bool {
+		return depot.Conn(addr) != nil
+	}, time.Second, time.Millisecond)
 	err = depot.DrainTo(recsback, addr)
 	rerec, err := tc.Feed()
 	relit, rebody, rerest := TakeAny(rerec[0])
@@ -84,3 +90,218 @@ func TestTCPDepot_Connect(t *testing.T) {
 	depot.Close()
 
 }
+
+// testPeer echoes if told so, otherwise collects incoming records
+type testPeer struct {
+	echo    bool
+	in, out toyqueue.Records
+	closed  bool
+	mx      sync.Mutex
+	co      sync.Cond
+}
+
+func newTestPeer(echo bool) *testPeer {
+	p := &testPeer{echo: echo}
+	p.co.L = &p.mx
+	return p
+}
+
+func (p *testPeer) Drain(recs toyqueue.Records) error {
+	p.mx.Lock()
+	if p.echo {
+		p.out = append(p.out, recs...)
+	} else {
+		p.in = append(p.in, recs...)
+	}
+	p.co.Broadcast()
+	p.mx.Unlock()
+	return nil
+}
+
+func (p *testPeer) Send(recs toyqueue.Records) {
+	p.mx.Lock()
+	p.out = append(p.out, recs...)
+	p.co.Broadcast()
+	p.mx.Unlock()
+}
+
+func (p *testPeer) Feed() (recs toyqueue.Records, err error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for len(p.out) == 0 && !p.closed {
+		p.co.Wait()
+	}
+	if p.closed {
+		return nil, toyqueue.ErrClosed
+	}
+	recs, p.out = p.out, nil
+	return
+}
+
+// Received waits for n incoming records
+func (p *testPeer) Received(n int) toyqueue.Records {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for len(p.in) < n && !p.closed {
+		p.co.Wait()
+	}
+	return p.in
+}
+
+func (p *testPeer) Close() error {
+	p.mx.Lock()
+	p.closed = true
+	p.co.Broadcast()
+	p.mx.Unlock()
+	return nil
+}
+
+func TestMemNet_Faults(t *testing.T) {
+	mem := MemNet{
+		Latency:  time.Millisecond,
+		MaxWrite: 3,
+	}
+	client := newTestPeer(false)
+	depot := TCPDepot{Net: &mem}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		if conn.RemoteAddr().String() == "server" {
+			return client
+		}
+		return newTestPeer(true)
+	})
+	assert.Nil(t, depot.Listen("server"))
+	assert.Equal(t, ErrAddressInUse, depot.Listen("server"))
+	assert.Equal(t, ErrRefused, depot.Connect("nowhere"))
+	assert.Nil(t, depot.Connect("server"))
+
+	const N = 10
+	for i := 0; i < N; i++ {
+		client.Send(Records('P', []byte("partial writes")))
+	}
+	recs := client.Received(N)
+	assert.Equal(t, N, len(recs))
+	for _, rec := range recs {
+		body, rest, err := TakeWary('P', rec)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(rest))
+		assert.Equal(t, "partial writes", string(body))
+	}
+
+	assert.Equal(t, 2, mem.Break("server"))
+	assert.Eventually(t, func() bool {
+		tcp := depot.Conn("server")
+		tcp.outmx.Lock()
+		defer tcp.outmx.Unlock()
+		return tcp.conn == nil
+	}, time.Second, time.Millisecond)
+	depot.Close()
+}
+
+type disconnectPeer struct {
+	*testPeer
+	over chan struct{}
+}
+
+func (p disconnectPeer) Disconnected() {
+	close(p.over)
+}
+
+func TestTCPDepot_Close(t *testing.T) {
+	mem := MemNet{}
+	server := TCPDepot{Net: &mem}
+	server.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newTestPeer(true)
+	})
+	assert.Nil(t, server.Listen("server"))
+	defer server.Close()
+	depot := TCPDepot{Net: &mem, Reconnect: true}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return newTestPeer(false)
+	})
+	assert.Nil(t, depot.Connect("server"))
+	tcp := depot.Conn("server")
+	depot.Close()
+	// no reconnects, no new connections
+	assert.True(t, tcp.isStopped())
+	assert.Equal(t, toyqueue.ErrClosed, depot.Connect("server"))
+	assert.Nil(t, depot.Conn("server"))
+}
+
+func TestTCPDepot_Disconnecter(t *testing.T) {
+	mem := MemNet{}
+	peers := make(chan disconnectPeer, 2)
+	depot := TCPDepot{Net: &mem}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		peer := disconnectPeer{newTestPeer(false), make(chan struct{})}
+		peers <- peer
+		return peer
+	})
+	defer depot.Close()
+	assert.Nil(t, depot.Listen("server"))
+	assert.Nil(t, depot.Connect("server"))
+	assert.Equal(t, 2, mem.Break("server"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-(<-peers).over:
+		case <-time.After(time.Second):
+			t.Fatal("not disconnected")
+		}
+	}
+	// the connection is still known, the inout is not closed
+	assert.NotNil(t, depot.Conn("server"))
+}
+
+func TestMemNet_Drop(t *testing.T) {
+	mem := MemNet{DropAfter: 10}
+	c1, err := mem.Listen("x")
+	assert.Nil(t, err)
+	go func() {
+		conn, _ := c1.Accept()
+		buf := make([]byte, 100)
+		var err error
+		for err == nil {
+			_, err = conn.Read(buf)
+		}
+	}()
+	conn, err := mem.Dial("x")
+	assert.Nil(t, err)
+	assert.Equal(t, "x", conn.RemoteAddr().String())
+	n, err := conn.Write(make([]byte, 8))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	n, err = conn.Write(make([]byte, 8))
+	assert.Equal(t, net.ErrClosed, err)
+	assert.Equal(t, 2, n)
+	_ = c1.Close()
+	_, err = mem.Dial("x")
+	assert.Equal(t, ErrRefused, err)
+}
+
+func TestTCPConn_BadAfterGood(t *testing.T) {
+	mem := MemNet{}
+	peer := newTestPeer(false)
+	depot := TCPDepot{Net: &mem}
+	depot.Open(func(conn net.Conn) toyqueue.FeedDrainCloser {
+		return peer
+	})
+	assert.Nil(t, depot.Listen("bad"))
+	defer depot.Close()
+
+	conn, err := mem.Dial("bad")
+	assert.Nil(t, err)
+	_, err = conn.Write(Concat(Record('A', []byte("fine")), []byte("!garbage")))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(peer.Received(1)))
+	// the depot hangs up instead of waiting for more
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err = <-read:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("the connection is still open")
+	}
+}
@@ -0,0 +1,204 @@
+package toytlv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The text notation for ToyTLV, handy for test fixtures and debugging:
+//
+//	M{ B"hello" b"short" 3:"abc" n{ x"\x00\x01" } }
+//
+// The case of the letter tells the header form: uppercase is long
+// (32-bit length), lowercase is short (8-bit length). Tiny records
+// go as the length digit and a colon. Bodies are either Go-quoted
+// strings or nested records in curly braces. As header forms are
+// preserved, any valid byte stream round-trips exactly.
+
+var ErrBadText = errors.New("bad TLV text notation")
+
+// Format prints TLV records in the text notation. Bodies that are
+// valid TLV (and not printable text) are printed as nested records.
+// The trailing bytes that are not a valid record, if any, are printed
+// as a bare quoted string, which Parse accepts as well.
+func Format(data []byte) string {
+	var sb strings.Builder
+	format(&sb, data)
+	return sb.String()
+}
+
+func format(sb *strings.Builder, data []byte) {
+	for len(data) > 0 {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		lit, hdrlen, bodylen := ProbeHeader(data)
+		if lit == 0 || lit == '-' || hdrlen+bodylen > len(data) {
+			sb.WriteString(strconv.Quote(string(data)))
+			return
+		}
+		switch hdrlen {
+		case 1:
+			sb.WriteByte(data[0])
+			sb.WriteByte(':')
+		case 2:
+			sb.WriteByte(lit | CaseBit)
+		default:
+			sb.WriteByte(lit)
+		}
+		body := data[hdrlen : hdrlen+bodylen]
+		if isNested(body) {
+			sb.WriteString("{ ")
+			var inner strings.Builder
+			format(&inner, body)
+			sb.WriteString(inner.String())
+			sb.WriteString(" }")
+		} else {
+			sb.WriteString(strconv.Quote(string(body)))
+		}
+		data = data[hdrlen+bodylen:]
+	}
+}
+
+func isNested(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	printable := utf8.Valid(body)
+	for i := 0; i < len(body) && printable; i++ {
+		printable = body[i] >= ' ' && body[i] < 0x7f
+	}
+	if printable {
+		return false
+	}
+	for len(body) > 0 {
+		lit, rec, rest := TakeAnyRecord(body)
+		if lit == 0 || lit == '-' || rec == nil {
+			return false
+		}
+		body = rest
+	}
+	return true
+}
+
+// Parse converts the text notation into TLV bytes.
+func Parse(text string) ([]byte, error) {
+	p := parser{text: text}
+	data, err := p.records(nil)
+	if err == nil && p.pos < len(p.text) {
+		err = p.fail()
+	}
+	return data, err
+}
+
+type parser struct {
+	text string
+	pos  int
+}
+
+func (p *parser) fail() error {
+	return fmt.Errorf("%w at %d", ErrBadText, p.pos)
+}
+
+func (p *parser) skip() {
+	for p.pos < len(p.text) && strings.IndexByte(" \t\r\n,", p.text[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// records parses a sequence till the end of text or a closing brace
+func (p *parser) records(into []byte) ([]byte, error) {
+	for {
+		p.skip()
+		if p.pos >= len(p.text) || p.text[p.pos] == '}' {
+			return into, nil
+		}
+		var err error
+		into, err = p.record(into)
+		if err != nil {
+			return into, err
+		}
+	}
+}
+
+func (p *parser) record(into []byte) ([]byte, error) {
+	c := p.text[p.pos]
+	switch {
+	case c == '"' || c == '`':
+		body, err := p.quoted()
+		return append(into, body...), err
+	case c >= 'A' && c <= 'Z':
+		p.pos++
+		bookmark, res := OpenHeader(into, c)
+		res, err := p.body(res)
+		if err == nil {
+			CloseHeader(res, bookmark)
+		}
+		return res, err
+	case c >= 'a' && c <= 'z':
+		p.pos++
+		body, err := p.body(nil)
+		if err != nil {
+			return into, err
+		}
+		if len(body) > 0xff {
+			return into, p.fail()
+		}
+		into = append(into, c, byte(len(body)))
+		return append(into, body...), nil
+	case c >= '0' && c <= '9':
+		p.pos++
+		if p.pos >= len(p.text) || p.text[p.pos] != ':' {
+			return into, p.fail()
+		}
+		p.pos++
+		body, err := p.body(nil)
+		if err != nil {
+			return into, err
+		}
+		if len(body) != int(c-'0') {
+			return into, p.fail()
+		}
+		into = append(into, c)
+		return append(into, body...), nil
+	default:
+		return into, p.fail()
+	}
+}
+
+func (p *parser) body(into []byte) ([]byte, error) {
+	p.skip()
+	if p.pos >= len(p.text) {
+		return into, p.fail()
+	}
+	if p.text[p.pos] != '{' {
+		body, err := p.quoted()
+		return append(into, body...), err
+	}
+	p.pos++
+	into, err := p.records(into)
+	if err != nil {
+		return into, err
+	}
+	if p.pos >= len(p.text) {
+		return into, p.fail()
+	}
+	p.pos++ // }
+	return into, nil
+}
+
+func (p *parser) quoted() ([]byte, error) {
+	prefix, err := strconv.QuotedPrefix(p.text[p.pos:])
+	if err != nil {
+		return nil, p.fail()
+	}
+	str, err := strconv.Unquote(prefix)
+	if err != nil {
+		return nil, p.fail()
+	}
+	p.pos += len(prefix)
+	return []byte(str), nil
+}
@@ -0,0 +1,44 @@
+package toytlv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data, err := Parse(`M{ B"hello" b"short" 3:"abc" n{ x"\x00\x01" } }`)
+	assert.Nil(t, err)
+	lit, body, rest := TakeAny(data)
+	assert.Equal(t, uint8('M'), lit)
+	assert.Equal(t, 0, len(rest))
+	assert.Equal(t, uint8('M'), data[0]) // long form kept
+	correct := Concat(
+		[]byte{'B', 5, 0, 0, 0}, []byte("hello"),
+		[]byte{'b', 5}, []byte("short"),
+		[]byte("3abc"),
+		[]byte{'n', 4, 'x', 2, 0, 1},
+	)
+	assert.Equal(t, correct, body)
+	assert.Equal(t, `M{ B"hello" b"short" 3:"abc" n{ x"\x00\x01" } }`, Format(data))
+
+	for _, bad := range []string{`M{`, `4:"abc"`, `m`, `!`, `M"abc`, `}`} {
+		_, err = Parse(bad)
+		assert.ErrorIs(t, err, ErrBadText, bad)
+	}
+}
+
+func TestFormat_RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, rnd.Intn(64))
+		rnd.Read(data)
+		if i&1 == 0 {
+			data = Record('A', Record('b', data), TinyRecord('c', data[:len(data)%10]))
+		}
+		text := Format(data)
+		back, err := Parse(text)
+		assert.Nil(t, err, text)
+		assert.Equal(t, string(data), string(back), text)
+	}
+}
@@ -59,7 +59,7 @@ func Incomplete(data []byte) int {
 	dlit := data[0]
 	bodylen := 1
 	if dlit >= '0' && dlit <= '9' { // tiny
-		bodylen = int(dlit - '0')
+		bodylen = int(dlit-'0') + 1
 	} else if dlit >= 'a' && dlit <= 'z' { // short
 		if len(data) < 2 {
 			bodylen = 2
@@ -180,13 +180,18 @@ func TakeWary(lit byte, data []byte) (body, rest []byte, err error) {
 	return
 }
 
-// TakeWary reads TLV records of arbitrary type from unsafe input.
+// TakeAnyWary reads TLV records of arbitrary type from unsafe input.
+// Tiny records have the type of '0'.
 func TakeAnyWary(data []byte) (lit byte, body, rest []byte, err error) {
-	if len(data) == 0 {
-		return 0, nil, nil, ErrIncomplete
+	lit, hdrlen, bodylen := ProbeHeader(data)
+	if lit == '-' {
+		return 0, nil, nil, ErrBadRecord
 	}
-	lit = data[0] & ^CaseBit
-	body, rest = Take(lit, data)
+	if lit == 0 || hdrlen+bodylen > len(data) {
+		return 0, nil, data, ErrIncomplete
+	}
+	body = data[hdrlen : hdrlen+bodylen]
+	rest = data[hdrlen+bodylen:]
 	return
 }
 
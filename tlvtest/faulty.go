@@ -0,0 +1,131 @@
+// Package tlvtest has faulty io.Reader and io.Writer implementations
+// to test TLV framing against, in the spirit of testing/iotest.
+package tlvtest
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+// OneByteReader reads one byte at a time.
+func OneByteReader(r io.Reader) io.Reader {
+	return &oneByteReader{r}
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+type errAfterReader struct {
+	r    io.Reader
+	left int
+	err  error
+}
+
+// ErrAfterReader returns err once n bytes are read.
+func ErrAfterReader(r io.Reader, n int, err error) io.Reader {
+	return &errAfterReader{r, n, err}
+}
+
+func (e *errAfterReader) Read(p []byte) (int, error) {
+	if e.left <= 0 {
+		return 0, e.err
+	}
+	if len(p) > e.left {
+		p = p[:e.left]
+	}
+	n, err := e.r.Read(p)
+	e.left -= n
+	return n, err
+}
+
+type zeroReader struct {
+	r    io.Reader
+	zero bool
+}
+
+// ZeroReader returns (0, nil) on every other read.
+func ZeroReader(r io.Reader) io.Reader {
+	return &zeroReader{r: r}
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	z.zero = !z.zero
+	if z.zero {
+		return 0, nil
+	}
+	return z.r.Read(p)
+}
+
+type chunkReader struct {
+	r      io.Reader
+	chunks []int
+	i      int
+}
+
+// ChunkReader reads no more than chunks[i] bytes on the i-th read,
+// cycling through chunks.
+func ChunkReader(r io.Reader, chunks ...int) io.Reader {
+	return &chunkReader{r: r, chunks: chunks}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	max := c.chunks[c.i%len(c.chunks)]
+	c.i++
+	if len(p) > max {
+		p = p[:max]
+	}
+	return c.r.Read(p)
+}
+
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+// ShortWriter writes at most max bytes per call, reporting a short
+// write with no error (io.Writer implementations must not do that,
+// but some do).
+func ShortWriter(w io.Writer, max int) io.Writer {
+	return &shortWriter{w, max}
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > s.max {
+		p = p[:s.max]
+	}
+	return s.w.Write(p)
+}
+
+type errAfterWriter struct {
+	w    io.Writer
+	left int
+	err  error
+}
+
+// ErrAfterWriter fails with err once n bytes are written.
+func ErrAfterWriter(w io.Writer, n int, err error) io.Writer {
+	return &errAfterWriter{w, n, err}
+}
+
+func (e *errAfterWriter) Write(p []byte) (n int, err error) {
+	if len(p) > e.left {
+		p = p[:e.left]
+		err = e.err
+	}
+	m, werr := e.w.Write(p)
+	e.left -= m
+	if werr != nil {
+		err = werr
+	}
+	return m, err
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+const maxIOV = 1024 // IOV_MAX
+
+// writev writes the records with writev(2), if the writer exposes
+// its file descriptor; returns done=false otherwise.
+func writev(w syscall.Conn, recs toyqueue.Records) (done bool, err error) {
+	raw, err := w.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	iovs := append(toyqueue.Records(nil), recs...)
+	var werr error
+	err = raw.Write(func(fd uintptr) bool {
+		for len(iovs) > 0 {
+			chunk := iovs
+			if len(chunk) > maxIOV {
+				chunk = chunk[:maxIOV]
+			}
+			n, e := unix.Writev(int(fd), chunk)
+			if e == unix.EINTR {
+				continue
+			} else if e == unix.EAGAIN {
+				return false // wait till writable
+			} else if e != nil {
+				werr = e
+				return true
+			}
+			for len(iovs) > 0 && n >= len(iovs[0]) {
+				n -= len(iovs[0])
+				iovs = iovs[1:]
+			}
+			if n > 0 {
+				iovs[0] = iovs[0][n:]
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	return true, err
+}
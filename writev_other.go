@@ -0,0 +1,12 @@
+//go:build !linux
+
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"syscall"
+)
+
+func writev(w syscall.Conn, recs toyqueue.Records) (done bool, err error) {
+	return false, nil
+}
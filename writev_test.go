@@ -0,0 +1,62 @@
+package toytlv
+
+import (
+	"github.com/learn-decentralized-systems/toyqueue"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+// plainWriter hides the file descriptor, so writes get bundled
+type plainWriter struct {
+	io.Writer
+}
+
+func manyRecords(n, size int) (recs toyqueue.Records) {
+	body := make([]byte, size)
+	for i := 0; i < n; i++ {
+		body[0] = byte(i)
+		recs = append(recs, Record('R', body))
+	}
+	return
+}
+
+func TestWriter2Drainer_Writev(t *testing.T) {
+	_ = os.Remove("tlvv")
+	file, err := os.Create("tlvv")
+	assert.Nil(t, err)
+	recs := manyRecords(3000, 10) // more than IOV_MAX
+	d := Writer2Drainer{Writer: file}
+	assert.Nil(t, d.Drain(recs))
+	_ = file.Close()
+	data, err := os.ReadFile("tlvv")
+	assert.Nil(t, err)
+	assert.Equal(t, Concat(recs...), data)
+	_ = os.Remove("tlvv")
+}
+
+func benchmarkDrain(b *testing.B, wrap func(f *os.File) io.Writer, size int) {
+	file, err := os.CreateTemp(b.TempDir(), "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	recs := manyRecords(64, size)
+	d := Writer2Drainer{Writer: wrap(file)}
+	b.SetBytes(int64(TotalLen(recs)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.Drain(recs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func fileWriter(f *os.File) io.Writer    { return f }
+func bundledWriter(f *os.File) io.Writer { return plainWriter{f} }
+
+func BenchmarkDrainWritevSmall(b *testing.B)  { benchmarkDrain(b, fileWriter, 32) }
+func BenchmarkDrainBundledSmall(b *testing.B) { benchmarkDrain(b, bundledWriter, 32) }
+func BenchmarkDrainWritevLarge(b *testing.B)  { benchmarkDrain(b, fileWriter, 4096) }
+func BenchmarkDrainBundledLarge(b *testing.B) { benchmarkDrain(b, bundledWriter, 4096) }